@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// runAlter is the whole alter, from getting the alter query to the swap, or with
+// copyOnly, to the end of the copy. Any error before the swap has started rolls back
+// everything we've made, and any error once the original table is gone prints
+// out what's left to do by hand
+func runAlter(db *mysql.Database, dbDSN string, tableHint string, copyOnly bool) (err error) {
+	start := time.Now()
+
+	switch *copyEngine {
+	case "server", "client", "load-data":
+	default:
+		return fmt.Errorf("unknown -engine %q, it can be server, client, or load-data", *copyEngine)
+	}
+	if *transport != "typed" && *transport != "raw" {
+		return fmt.Errorf("unknown -transport %q, it can be typed or raw", *transport)
+	}
+	if *workers < 1 {
+		return errors.New("-workers needs to be at least 1")
+	}
+
+	// when resuming, the alter comes from the state of the run we're resuming
+	var st *state
+	var alterQuery string
+	if *resume {
+		if len(tableHint) == 0 {
+			return errors.New("-resume needs the table being altered, ex: smg-live-alter -resume localhost orders")
+		}
+		st, err = loadState(stateFile(dbDSN, tableHint))
+		if err != nil {
+			return err
+		}
+		alterQuery = st.Alter
+	} else {
+		alterQuery, err = readAlter(db, tableHint)
+		if err != nil {
+			return err
+		}
+	}
+
+	tableName, alterPart, err := parseAlter(alterQuery)
+	if err != nil {
+		return err
+	}
+
+	// keep a copy of every alter we're given so it can be recalled later,
+	// but not being able to save it is no reason to stop the alter
+	if !*lastAlter && !*resume {
+		if err := saveHistory(alterQuery, tableName); err != nil {
+			log.Println(color.YellowString("failed to save alter to history: %v", err))
+		}
+	}
+
+	hr := strings.Repeat("+", 64)
+	log.Printf("using alter query:\n%s\n%s\n%s\n", hr, color.CyanString(alterQuery), hr)
+
+	p, err := newPlan(db, tableName, alterPart)
+	if err != nil {
+		return err
+	}
+
+	// a swap is the very last thing we do, and far too late to find out it can't be done
+	if *atomicCutover || keepingOld() {
+		err = p.checkSwap()
+		if err != nil {
+			return fmt.Errorf("-atomic-cutover, -keep-old, and -reverse-sync can't be used here: %w", err)
+		}
+	}
+
+	// with a dry run we just show everything we would've done, and stop
+	if *dryRunFlag {
+		return dryRun(db, p, alterQuery, os.Stdout)
+	}
+
+	// from here on out we're making things that shouldn't outlive a failed run,
+	// so the guard keeps track of what needs undoing if something goes wrong
+	g := newGuard(db, p)
+	g.watchSignals()
+	defer func() {
+		if err != nil {
+			g.fail(err)
+		}
+	}()
+
+	tempTableName := p.tempTableName
+
+	// timestamps go from the original table to our temp table as strings in the
+	// session time zone, so everything that moves them runs in utc, where
+	// every string is exactly one instant, and in a sql_mode that lets
+	// the rows already in the original table into the temp table
+	mode, err := copySQLMode(db, p, st)
+	if err != nil {
+		return err
+	}
+	log.Printf("copying with sql_mode %q", mode)
+	copyDB, err := copyDatabase(db, mode)
+	if err != nil {
+		return err
+	}
+	defer closeCopyDatabase(copyDB)
+
+	var deferred []string
+	err = g.step(func() error {
+		// the temp table and triggers we're resuming with hold all of the progress
+		// the earlier run made, so they're never ours to roll back
+		if st != nil {
+			g.resumed = true
+			return nil
+		}
+		g.created = true
+
+		// delete the table from our destination
+		log.Println("dropping temp table (if it exists)")
+		err := db.Exec("drop table if exists`" + tempTableName + "`")
+		if err != nil {
+			return err
+		}
+
+		// now we can make the table on our destination
+		log.Println("creating temp table")
+		err = db.Exec(p.createTempTable)
+		if err != nil {
+			return err
+		}
+
+		log.Println("applying alter to temp table")
+		err = db.Exec(p.alterTempTableSQL())
+		if err != nil {
+			return err
+		}
+
+		if *deferredIndexes {
+			deferred, err = deferIndexes(db, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if st != nil {
+		// we're picking up where an earlier run left off, so our temp table and
+		// triggers had better still be exactly how that run left them
+		err = checkCopy(db, p, st)
+		if err != nil {
+			return fmt.Errorf("can't resume: %w", err)
+		}
+		log.Printf("resuming copy after %d rows", st.copied())
+		if len(st.Ranges) != *workers {
+			log.Printf("the run was split into %d ranges when it started, so that's how many workers it resumes with", len(st.Ranges))
+		}
+	} else {
+		oldColumns, err := getTableColumns(db, tableName)
+		if err != nil {
+			return err
+		}
+
+		newColumns, err := getTableColumns(db, tempTableName)
+		if err != nil {
+			return err
+		}
+
+		err = p.mapColumns(oldColumns, newColumns)
+		if err != nil {
+			return err
+		}
+
+		// this is the last chance to back out before the triggers are
+		// slowing down every write, and there's a copy to lose
+		if !*skipExplain {
+			err = checkKeysetPlan(db, p)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = g.step(func() error {
+			for _, t := range p.triggers() {
+				log.Printf("dropping %s trigger (if it exists)", t.event)
+				err := copyDB.Exec("drop trigger if exists`" + t.name + "`")
+				if err != nil {
+					return err
+				}
+				log.Printf("creating %s trigger", t.event)
+				err = copyDB.Exec(t.createSQL())
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// everything written from here on is copied by our triggers, so the copy only
+		// has to get as far as the last row there is right now, no matter how many
+		// rows are inserted while it's copying
+		st = newState(stateFile(dbDSN, tableName), p, alterQuery)
+		st.DeferredIndexes = deferred
+		st.SQLMode = &mode
+		var last []struct {
+			Bound string
+		}
+		err = copyDB.Select(&last, p.lastRowQuery(), 0)
+		if err != nil {
+			return err
+		}
+		if len(last) == 0 {
+			// an empty table is copied as soon as it has triggers
+			st.Ranges = []*keyRange{{Done: true}}
+		} else {
+			// and guess the count, so we can show our swick progress bars,
+			// since actually counting them means reading every one of them
+			log.Println("estimating row count")
+			st.Total, err = estimateRows(copyDB, p, last[0].Bound)
+			if err != nil {
+				return err
+			}
+
+			st.Ranges, err = splitRanges(copyDB, p, *workers, last[0].Bound, st.Total)
+			if err != nil {
+				return err
+			}
+		}
+		err = st.save()
+		if err != nil {
+			return err
+		}
+	}
+	g.st = st
+
+	t, err := newThrottler(db, dbDSN)
+	if err != nil {
+		return err
+	}
+
+	var c *controller
+	if *controlSocket != "off" {
+		path := *controlSocket
+		if len(path) == 0 {
+			path = controlSocketFile(dbDSN, tableName)
+		}
+		c, err = listenControl(path, g, t)
+		if err != nil {
+			// without the socket there'd be no way to unpostpone
+			if *postponeCutover {
+				return fmt.Errorf("failed to listen on control socket: %w", err)
+			}
+			log.Println(color.YellowString("failed to listen on control socket: %v", err))
+		}
+	}
+	defer c.close()
+
+	progress := mpb.New()
+
+	// our pretty bar config for the progress bars
+	// their documentation lives over here https://github.com/vbauerster/mpb
+	bar := progress.New(st.Total,
+		mpb.BarStyle().Lbound("|").Filler("▇").Tip("▇").Padding(" ").Rbound("|"),
+		mpb.PrependDecorators(
+			decor.Name(color.HiBlueString(tableName)),
+			decor.OnComplete(decor.Percentage(decor.WC{W: 5}), color.HiMagentaString(" done!")),
+		),
+		mpb.AppendDecorators(
+			decor.CountersNoUnit("( "+color.HiCyanString("%d/%d")+", ", decor.WCSyncWidth),
+			decor.AverageSpeed(-1, " "+color.HiGreenString("%.2f/s")+" ) ", decor.WCSyncWidth),
+			decor.AverageETA(decor.ET_STYLE_MMSS),
+			decor.Any(func(decor.Statistics) string {
+				if reason := t.status(); len(reason) != 0 {
+					return color.YellowString(" paused, %s", reason)
+				}
+				return ""
+			}),
+		),
+	)
+	bar.SetCurrent(st.copied())
+	// the total is only an estimate, so the bar isn't done
+	// until we say so, even if it gets there early
+	bar.SetTotal(st.Total, false)
+	c.setBar(bar)
+
+	err = copyRanges(copyDB, p, st, bar, g, t)
+	if err != nil {
+		bar.Abort(false)
+		progress.Wait()
+		return err
+	}
+
+	// and just in case the rows have changed count since our count selection,
+	// we'll just tell the progress bar that we're finished
+	bar.SetTotal(bar.Current(), true)
+
+	progress.Wait()
+
+	if n := coercedValues.Load(); n != 0 {
+		log.Println(color.YellowString("%d values were changed to fit %s, see the rows above", n, tempTableName))
+	}
+
+	// only the engines that read rows out of mysql can shift a timestamp, since insert...select
+	// never makes strings of them. The check reads the whole table again, so it's
+	// throttled just like the copy
+	if *copyEngine != "server" {
+		err = verifyTimestamps(copyDB, p, g, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	// every row pays for an index while it's copied, but building
+	// one from rows that are already there is much cheaper
+	if len(st.DeferredIndexes) != 0 {
+		err = addIndexes(db, p, st.DeferredIndexes, g)
+		if err != nil {
+			return err
+		}
+		st.DeferredIndexes = nil
+	}
+
+	if err := st.finishCopy(); err != nil {
+		log.Println(color.YellowString("failed to save state: %v", err))
+	}
+
+	// nothing is done in the copy's sql_mode from here on, and its connections
+	// shouldn't sit around through a cutover that could be postponed for days
+	closeCopyDatabase(copyDB)
+
+	if copyOnly {
+		g.finish()
+		log.Printf("finished copying %s in %s, our triggers will keep it up to date until \"smg-live-alter cutover <connection> %s\"", tableName, time.Since(start), tableName)
+		return nil
+	}
+
+	// a postponed cutover is decided on from the control socket,
+	// so nobody has to keep a terminal open waiting to say yes
+	if c.isPostponed() {
+		err = c.waitUnpostponed()
+		if err != nil {
+			return err
+		}
+	} else if !yesNo("do the drop/swap?") {
+		// the copy is done and being kept up to date by our triggers,
+		// which is exactly what someone saying no here wants to keep
+		g.finish()
+		log.Printf("run \"smg-live-alter cutover <connection> %s\" whenever you're ready", tableName)
+		return nil
+	}
+
+	err = runCutover(db, dbDSN, p, st, g)
+	if err != nil {
+		return err
+	}
+
+	log.Println("finished altering", tableName, "in", time.Since(start))
+
+	return nil
+}
+
+// parseAlter gets the table name and the rest of the alter from an alter query
+func parseAlter(alterQuery string) (tableName string, alterPart string, err error) {
+	m := parseAlterRegexp.FindStringSubmatch(alterQuery)
+	if len(m) != 4 {
+		return "", "", errors.New("couldn't parse alter query, is it valid?")
+	}
+	return m[2], m[3], nil
+}
+
+// runCutover swaps the finished copy in for the original table, and whatever
+// comes after, like keeping the original table or the reverse sync
+func runCutover(db *mysql.Database, dbDSN string, p *plan, st *state, g *guard) error {
+	tableName := p.tableName
+
+	// an atomic cutover holds its locks for every step, and locks
+	// belong to a connection, so it gets a connection all to itself
+	exec := func(query string) error {
+		return db.Exec(query)
+	}
+	if *atomicCutover || keepingOld() {
+		ctx := context.Background()
+		conn, err := db.Writes.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		// this runs before the guard gets the chance to roll anything back,
+		// which it couldn't do while we're still holding the locks
+		defer func() {
+			conn.ExecContext(ctx, "unlock tables")
+			conn.ExecContext(ctx, "set foreign_key_checks=1")
+			conn.Close()
+		}()
+		exec = func(query string) error {
+			_, err := conn.ExecContext(ctx, query)
+			return err
+		}
+	}
+
+	// stop foreign key checks
+	log.Println("disabling foreign key checks for our connection")
+	err := exec("set foreign_key_checks=0")
+	if err != nil {
+		return err
+	}
+
+	// but we can't forget our triggers!
+	// lets grab the triggers from the source table and make sure
+	// we re-create them all on our destination
+	log.Println("getting original triggers")
+	triggers, err := getTriggers(db, tableName)
+	if err != nil {
+		return err
+	}
+
+	steps, err := p.planCutover(db, triggers)
+	if err != nil {
+		return err
+	}
+
+	err = g.cutover(newJournal(journalFile(dbDSN, tableName), p, steps), exec)
+	if err != nil {
+		return err
+	}
+
+	// the kept table's constraints are gone now, so we
+	// remember them in case it ever gets rolled back to
+	if keepingOld() {
+		k := &keptTable{
+			Table:       tableName,
+			OldTable:    p.oldTableName,
+			Constraints: p.constraints,
+			Kept:        time.Now(),
+			file:        keptFile(dbDSN, tableName),
+		}
+		if *reverseSync > 0 {
+			k.ReverseSyncUntil = k.Kept.Add(*reverseSync)
+		}
+		if err := k.save(); err != nil {
+			log.Println(color.YellowString("failed to save the kept table's constraints: %v", err))
+		}
+		log.Printf("kept the original table as %s, use the rollback command to swap it back in or purge-old to drop it", p.oldTableName)
+	}
+
+	if *reverseSync > 0 {
+		err = waitReverseSync(db, p, g)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := st.remove(); err != nil {
+		log.Println(color.YellowString("failed to remove state: %v", err))
+	}
+
+	return nil
+}
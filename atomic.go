@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+)
+
+// childForeignKey is a foreign key on another table that points to the table being
+// altered. Renaming a table takes these along with it, so after an atomic swap they'd
+// all point to the old table, and have to be pointed back at the new one
+type childForeignKey struct {
+	ConstraintName    string
+	TableName         string
+	Columns           string
+	ReferencedColumns string
+	UpdateRule        string
+	DeleteRule        string
+}
+
+func (fk childForeignKey) dropSQL() string {
+	return "alter table`" + fk.TableName + "`drop foreign key`" + fk.ConstraintName + "`"
+}
+
+func (fk childForeignKey) addSQL(tableName string) string {
+	return "alter table`" + fk.TableName + "`add constraint`" + fk.ConstraintName + "`" +
+		"foreign key(" + fk.Columns + ")references`" + tableName + "`(" + fk.ReferencedColumns + ")" +
+		"on delete " + fk.DeleteRule + " on update " + fk.UpdateRule
+}
+
+// getChildForeignKeys gets the foreign keys of every other table that point to ours.
+// Our own table's foreign keys to itself aren't included, since those are part of
+// the constraints we stripped and get added back like the rest of them
+func getChildForeignKeys(db *mysql.Database, tableName string) ([]childForeignKey, error) {
+	var fks []childForeignKey
+	err := db.Select(&fks, "select rc.`CONSTRAINT_NAME`,rc.`TABLE_NAME`,rc.`UPDATE_RULE`,rc.`DELETE_RULE`,"+
+		"group_concat(concat('`',replace(kcu.`COLUMN_NAME`,'`','``'),'`')order by kcu.`ORDINAL_POSITION`)`Columns`,"+
+		"group_concat(concat('`',replace(kcu.`REFERENCED_COLUMN_NAME`,'`','``'),'`')order by kcu.`ORDINAL_POSITION`)`ReferencedColumns`"+
+		"from`information_schema`.`REFERENTIAL_CONSTRAINTS`rc "+
+		"join`information_schema`.`KEY_COLUMN_USAGE`kcu on kcu.`CONSTRAINT_SCHEMA`=rc.`CONSTRAINT_SCHEMA`"+
+		"and kcu.`TABLE_NAME`=rc.`TABLE_NAME`"+
+		"and kcu.`CONSTRAINT_NAME`=rc.`CONSTRAINT_NAME`"+
+		"where rc.`CONSTRAINT_SCHEMA`=database()"+
+		"and rc.`REFERENCED_TABLE_NAME`=@@table "+
+		"and rc.`TABLE_NAME`<>@@table "+
+		"group by rc.`CONSTRAINT_NAME`,rc.`TABLE_NAME`,rc.`UPDATE_RULE`,rc.`DELETE_RULE`"+
+		"order by rc.`TABLE_NAME`,rc.`CONSTRAINT_NAME`", 0, mysql.Params{
+		"table": tableName,
+	})
+	return fks, err
+}
+
+// getParentTables gets the tables our table's foreign keys point to, other than itself
+func getParentTables(db *mysql.Database, tableName string) ([]string, error) {
+	var parents []struct {
+		ReferencedTableName string
+	}
+	err := db.Select(&parents, "select distinct`REFERENCED_TABLE_NAME``ReferencedTableName`"+
+		"from`information_schema`.`REFERENTIAL_CONSTRAINTS`"+
+		"where`CONSTRAINT_SCHEMA`=database()"+
+		"and`TABLE_NAME`=@@table "+
+		"and`REFERENCED_TABLE_NAME`<>@@table", 0, mysql.Params{
+		"table": tableName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(parents))
+	for i, p := range parents {
+		names[i] = p.ReferencedTableName
+	}
+	return names, nil
+}
+
+var constraintKindsRegexp = regexp.MustCompile("(?m)^\\s*CONSTRAINT `([^`]+)` (FOREIGN KEY|CHECK)")
+
+// dropConstraintsSQL drops a block of constraints from the given table,
+// and is empty if there aren't any constraints
+func dropConstraintsSQL(tableName string, constraints string) string {
+	var drops []string
+	for _, m := range constraintKindsRegexp.FindAllStringSubmatch(constraints, -1) {
+		if m[2] == "CHECK" {
+			drops = append(drops, "drop check`"+m[1]+"`")
+		} else {
+			drops = append(drops, "drop foreign key`"+m[1]+"`")
+		}
+	}
+	if len(drops) == 0 {
+		return ""
+	}
+	return "alter table`" + tableName + "`" + strings.Join(drops, ",")
+}
+
+// renamedConstraints is a block of constraints from the table named from, with the names
+// mysql made up for its unnamed foreign keys and checks, like orders_ibfk_1 and orders_chk_1,
+// changed to the ones they get when the table is renamed to, since renaming a table
+// renames those along with it
+func renamedConstraints(constraints string, from string, to string) string {
+	re := regexp.MustCompile("CONSTRAINT `" + regexp.QuoteMeta(from) + "(_ibfk_[0-9]+|_chk_[0-9]+)`")
+	return re.ReplaceAllString(constraints, "CONSTRAINT `"+strings.ReplaceAll(to, "$", "$$")+"${1}`")
+}
+
+// swap is one table taking another's name with a single atomic rename,
+// which is how both an atomic cutover and rolling back to a kept table work
+type swap struct {
+	// table is the name being swapped, incoming is the table that
+	// gets it, and outgoing is what the table that has it now gets renamed to
+	table    string
+	incoming string
+	outgoing string
+
+	// via is the name the outgoing table passes through when
+	// the incoming and outgoing tables are trading names
+	via string
+
+	// outgoingConstraints are the constraints on the outgoing table, which have to come off
+	// of it to free up their names, and incomingConstraints are what go on the incoming table
+	outgoingConstraints string
+	incomingConstraints string
+
+	// helperTriggers are our sync triggers on the outgoing table, which are just dropped,
+	// and triggers are the outgoing table's own, which are moved to the incoming table
+	helperTriggers []string
+	triggers       []*trigger
+
+	// reverseTriggers mirror writes on the incoming table back into the
+	// outgoing one, and are made before anyone can write to the incoming table
+	reverseTriggers []syncTrigger
+
+	// keep leaves the outgoing table behind instead of dropping it
+	keep bool
+}
+
+// steps swaps the incoming table in for the outgoing one, so that there's never
+// a moment where the table doesn't exist.
+//
+// Everything happens while holding a write lock on every table involved, so the
+// steps have to be run on the same connection, and nobody sees the table until
+// it's finished. After the rename, the outgoing table's triggers and constraints
+// are still on it, so we move them over to the incoming table, and then point the
+// other tables' foreign keys, which followed the outgoing table to its
+// new name, back at the table name. With foreign key checks off, none of these
+// have to look at a single row, so the lock is only held for a moment
+func (s swap) steps(db *mysql.Database) ([]cutoverStep, error) {
+	log.Println("getting foreign keys that point to", s.table)
+	children, err := getChildForeignKeys(db, s.table)
+	if err != nil {
+		return nil, err
+	}
+
+	parents, err := getParentTables(db, s.table)
+	if err != nil {
+		return nil, err
+	}
+
+	// adding or dropping a foreign key under a lock needs
+	// both of the tables it's between to be locked
+	locked := []string{s.table, s.incoming}
+	seen := map[string]bool{s.table: true, s.incoming: true}
+	for _, t := range parents {
+		if !seen[t] {
+			seen[t] = true
+			locked = append(locked, t)
+		}
+	}
+	for _, fk := range children {
+		if !seen[fk.TableName] {
+			seen[fk.TableName] = true
+			locked = append(locked, fk.TableName)
+		}
+	}
+
+	steps := make([]cutoverStep, 0, len(s.helperTriggers)+len(s.triggers)*2+len(children)*2+7)
+
+	steps = append(steps, cutoverStep{
+		Description: "locking " + strings.Join(locked, ", "),
+		Query:       "lock tables`" + strings.Join(locked, "`write,`") + "`write",
+		Kind:        stepLock,
+	})
+
+	rename := "rename table`" + s.table + "`to`" + s.outgoing + "`,`" + s.incoming + "`to`" + s.table + "`"
+	if s.incoming == s.outgoing {
+		rename = "rename table`" + s.table + "`to`" + s.via + "`,`" + s.incoming + "`to`" + s.table + "`,`" + s.via + "`to`" + s.outgoing + "`"
+	}
+	steps = append(steps, cutoverStep{
+		Description: "swapping " + s.incoming + " in for " + s.table,
+		Query:       rename,
+		Kind:        stepSwap,
+		Table:       s.incoming,
+	})
+
+	// our sync triggers came along with the outgoing table, and since nothing
+	// can write to it while we hold the lock, there's nothing left for them to do
+	for _, name := range s.helperTriggers {
+		steps = append(steps, cutoverStep{
+			Description: "dropping trigger " + name,
+			Query:       "drop trigger if exists`" + name + "`",
+			Kind:        stepDropTrigger,
+			Table:       s.outgoing,
+			Names:       []string{name},
+		})
+	}
+
+	// constraint names are unique to the whole schema, so they have to come off the
+	// outgoing table before they can go on the incoming one. The unnamed ones were
+	// renamed along with the outgoing table, and are only found by their new names
+	outgoingConstraints := renamedConstraints(s.outgoingConstraints, s.table, s.outgoing)
+	if dropConstraints := dropConstraintsSQL(s.outgoing, outgoingConstraints); len(dropConstraints) != 0 {
+		steps = append(steps, cutoverStep{
+			Description: "dropping constraints from " + s.outgoing,
+			Query:       dropConstraints,
+			Kind:        stepDropConstraints,
+			Table:       s.outgoing,
+			Names:       constraintNames(outgoingConstraints),
+		})
+	}
+	if addConstraints := addConstraintsSQL(s.table, s.incomingConstraints); len(addConstraints) != 0 {
+		steps = append(steps, cutoverStep{
+			Description: "adding constraints",
+			Query:       addConstraints,
+			Kind:        stepConstraints,
+			Table:       s.table,
+			Names:       constraintNames(s.incomingConstraints),
+		})
+	}
+
+	// same goes for trigger names
+	for _, r := range s.triggers {
+		steps = append(steps, cutoverStep{
+			Description: "dropping original trigger " + r.Trigger + " from " + s.outgoing,
+			Query:       "drop trigger if exists`" + r.Trigger + "`",
+			Kind:        stepDropTrigger,
+			Table:       s.outgoing,
+			Names:       []string{r.Trigger},
+		})
+		steps = append(steps, cutoverStep{
+			Description: "adding original trigger " + r.Trigger,
+			Query:       renameTriggerTable(r.CreateMySQL, s.table),
+			Kind:        stepTrigger,
+			Table:       s.table,
+			Names:       []string{r.Trigger},
+		})
+	}
+
+	for _, fk := range children {
+		steps = append(steps, cutoverStep{
+			Description: "dropping foreign key " + fk.ConstraintName + " from " + fk.TableName,
+			Query:       fk.dropSQL(),
+			Kind:        stepDropConstraints,
+			Table:       fk.TableName,
+			Names:       []string{fk.ConstraintName},
+		})
+		steps = append(steps, cutoverStep{
+			Description: "pointing foreign key " + fk.ConstraintName + " of " + fk.TableName + " to " + s.table,
+			Query:       fk.addSQL(s.table),
+			Kind:        stepConstraints,
+			Table:       fk.TableName,
+			Names:       []string{fk.ConstraintName},
+		})
+	}
+
+	for _, t := range s.reverseTriggers {
+		steps = append(steps, cutoverStep{
+			Description: "creating reverse " + t.event + " trigger",
+			Query:       t.createSQL(),
+			Kind:        stepTrigger,
+			Table:       s.table,
+			Names:       []string{t.name},
+		})
+	}
+
+	steps = append(steps, cutoverStep{
+		Description: "unlocking tables",
+		Query:       "unlock tables",
+		Kind:        stepUnlock,
+	})
+
+	if !s.keep {
+		steps = append(steps, cutoverStep{
+			Description: "dropping " + s.outgoing,
+			Query:       "drop table if exists`" + s.outgoing + "`",
+			Kind:        stepDrop,
+			Table:       s.outgoing,
+		})
+	}
+
+	return steps, nil
+}
+
+// atomicCutoverSteps swaps our temp table in for the original table with a single
+// atomic rename, instead of dropping the original table first. This is also how
+// -keep-old works, since renaming the original table out of the way drags the
+// other tables' foreign keys along with it, just like an atomic rename does
+func (p *plan) atomicCutoverSteps(db *mysql.Database, triggers []*trigger) ([]cutoverStep, error) {
+	helperTriggers := make([]string, 0, 3)
+	for _, t := range p.triggers() {
+		helperTriggers = append(helperTriggers, t.name)
+	}
+
+	var reverseTriggers []syncTrigger
+	if *reverseSync > 0 {
+		reverseTriggers = p.reverseTriggers()
+	}
+
+	return swap{
+		table:               p.tableName,
+		incoming:            p.tempTableName,
+		outgoing:            p.oldTableName,
+		outgoingConstraints: p.constraints,
+		incomingConstraints: p.constraints,
+		helperTriggers:      helperTriggers,
+		triggers:            triggers,
+		reverseTriggers:     reverseTriggers,
+		keep:                keepingOld(),
+	}.steps(db)
+}
+
+// lockedRenames reports whether a server of the given version can rename tables that
+// it's holding write locks on, which every swap does, and which mysql can only do
+// since 8.0.13. MariaDB won't rename a table while anything is locked at all
+func lockedRenames(version string) bool {
+	if strings.Contains(version, "MariaDB") {
+		return false
+	}
+
+	// versions can have more after them, like 8.0.36-0ubuntu0.22.04.1
+	var parts [3]int
+	for i, part := range strings.SplitN(version, ".", 3) {
+		end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if end != -1 {
+			part = part[:end]
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return false
+		}
+		parts[i] = n
+	}
+	return slices.Compare(parts[:], []int{8, 0, 13}) >= 0
+}
+
+// checkSwap makes sure the server can swap tables, before we've started
+// on anything that would need a swap to finish
+func (p *plan) checkSwap() error {
+	if lockedRenames(p.serverVersion) {
+		return nil
+	}
+	return fmt.Errorf("swapping tables needs RENAME TABLE under LOCK TABLES, which needs MySQL 8.0.13 or newer, and this server is %s", p.serverVersion)
+}
+
+// keepingOld is whether the original table is being kept after the cutover,
+// which a reverse sync needs, since that's where it's syncing to
+func keepingOld() bool {
+	return *keepOld || *reverseSync > 0
+}
+
+// planCutover gets the cutover steps for whichever kind of cutover we were asked to do.
+// Anything other than the plain cutover holds locks, and has to be run on one connection
+func (p *plan) planCutover(db *mysql.Database, triggers []*trigger) ([]cutoverStep, error) {
+	if *atomicCutover || keepingOld() {
+		return p.atomicCutoverSteps(db, triggers)
+	}
+	return p.cutoverSteps(triggers), nil
+}
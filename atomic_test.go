@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRenamedConstraints(t *testing.T) {
+	tests := []struct {
+		name        string
+		constraints string
+		want        string
+	}{
+		{
+			name:        "unnamed foreign key",
+			constraints: ",\n  CONSTRAINT `orders_ibfk_1` FOREIGN KEY (`CustomerID`) REFERENCES `customers` (`CustomerID`)",
+			want:        ",\n  CONSTRAINT `orders_smgla_old_ibfk_1` FOREIGN KEY (`CustomerID`) REFERENCES `customers` (`CustomerID`)",
+		},
+		{
+			name:        "unnamed check",
+			constraints: ",\n  CONSTRAINT `orders_chk_12` CHECK ((`Total` >= 0))",
+			want:        ",\n  CONSTRAINT `orders_smgla_old_chk_12` CHECK ((`Total` >= 0))",
+		},
+		{
+			name:        "named foreign key",
+			constraints: ",\n  CONSTRAINT `fk_orders_customer` FOREIGN KEY (`CustomerID`) REFERENCES `customers` (`CustomerID`)",
+			want:        ",\n  CONSTRAINT `fk_orders_customer` FOREIGN KEY (`CustomerID`) REFERENCES `customers` (`CustomerID`)",
+		},
+		{
+			name:        "another table's prefix",
+			constraints: ",\n  CONSTRAINT `orders_items_ibfk_1` FOREIGN KEY (`ItemID`) REFERENCES `items` (`ItemID`)",
+			want:        ",\n  CONSTRAINT `orders_items_ibfk_1` FOREIGN KEY (`ItemID`) REFERENCES `items` (`ItemID`)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renamedConstraints(tt.constraints, "orders", "orders_smgla_old"); got != tt.want {
+				t.Errorf("renamedConstraints() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSwapUnnamedForeignKey runs the steps of an atomic cutover, and of a rollback
+// to the kept table, on a table with a foreign key that mysql named itself, which
+// gets renamed along with the table
+func TestSwapUnnamedForeignKey(t *testing.T) {
+	db := testDB(t)
+
+	const (
+		parent = "smgla_test_parent"
+		table  = "smgla_test_child"
+	)
+
+	testExec(t, db,
+		"drop table if exists`"+table+"`,`"+table+*tempTableSuffix+"`,`"+table+*oldTableSuffix+"`,`"+parent+"`",
+		"create table`"+parent+"`(`ID`int primary key)",
+		"create table`"+table+"`(`ID`int primary key,`ParentID`int,foreign key(`ParentID`)references`"+parent+"`(`ID`))",
+	)
+	t.Cleanup(func() {
+		db.Exec("drop table if exists`" + table + "`,`" + table + *tempTableSuffix + "`,`" + table + *oldTableSuffix + "`,`" + parent + "`")
+	})
+
+	run := func(s swap) {
+		t.Helper()
+
+		steps, err := s.steps(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		conn, err := db.Writes.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		defer conn.ExecContext(ctx, "unlock tables")
+
+		if _, err := conn.ExecContext(ctx, "set foreign_key_checks=0"); err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range steps {
+			if _, err := conn.ExecContext(ctx, step.Query); err != nil {
+				t.Fatalf("%s: %v", step.Description, err)
+			}
+		}
+	}
+
+	p, err := newPlan(db, table, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExec(t, db, p.createTempTable)
+
+	// the cutover, keeping the original table
+	run(swap{
+		table:               table,
+		incoming:            p.tempTableName,
+		outgoing:            p.oldTableName,
+		outgoingConstraints: p.constraints,
+		incomingConstraints: p.constraints,
+		keep:                true,
+	})
+
+	exists, err := constraintExists(db, table, table+"_ibfk_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("%s_ibfk_1 isn't on %s after the cutover", table, table)
+	}
+
+	// and the rollback, which swaps the kept table back in
+	run(swap{
+		table:               table,
+		incoming:            p.oldTableName,
+		outgoing:            p.oldTableName,
+		via:                 p.tempTableName,
+		outgoingConstraints: p.constraints,
+		incomingConstraints: p.constraints,
+		keep:                true,
+	})
+
+	exists, err = constraintExists(db, table, table+"_ibfk_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("%s_ibfk_1 isn't on %s after the rollback", table, table)
+	}
+	exists, err = constraintExists(db, p.oldTableName, p.oldTableName+"_ibfk_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("%s_ibfk_1 is still on %s after the rollback", p.oldTableName, p.oldTableName)
+	}
+}
+
+func TestLockedRenames(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"8.0.13", true},
+		{"8.0.36-0ubuntu0.22.04.1", true},
+		{"8.4.0-log", true},
+		{"9.1.0", true},
+		{"8.0.12", false},
+		{"5.7.44-log", false},
+		{"10.11.6-MariaDB-0+deb12u1", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := lockedRenames(tt.version); got != tt.want {
+			t.Errorf("lockedRenames(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
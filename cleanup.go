@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+)
+
+// leftoverTable is one of our temp tables that's still hanging around
+type leftoverTable struct {
+	TableName   string `mysql:"TABLE_NAME"`
+	TableRows   int64  `mysql:"TABLE_ROWS"`
+	DataLength  int64  `mysql:"DATA_LENGTH"`
+	IndexLength int64  `mysql:"INDEX_LENGTH"`
+}
+
+// leftoverTrigger is one of our sync triggers that's still on a table,
+// making every write to that table pay for a copy nobody is waiting for
+type leftoverTrigger struct {
+	TriggerName string `mysql:"TRIGGER_NAME"`
+	TableName   string `mysql:"EVENT_OBJECT_TABLE"`
+	Event       string `mysql:"EVENT_MANIPULATION"`
+	Statement   string `mysql:"ACTION_STATEMENT"`
+}
+
+// cleanup finds all of the temp tables and sync triggers in the schema that match
+// our suffix, optionally only for a single table, shows them, and drops them once confirmed.
+// The triggers are always dropped first, because a trigger that writes into
+// a table that no longer exists breaks every write to the original table
+func cleanup(db *mysql.Database, dbDSN string, tableName string) error {
+	suffix := *tempTableSuffix
+
+	// underscores are wildcards in "like", and our default suffix is full of them,
+	// so the like only narrows things down and we check the suffix for real below
+	like := "%" + strings.NewReplacer(`\`, `\\`, `_`, `\_`, `%`, `\%`).Replace(suffix)
+
+	var tables []leftoverTable
+	err := db.Select(&tables, "select`TABLE_NAME`,coalesce(`TABLE_ROWS`,0)`TABLE_ROWS`,"+
+		"coalesce(`DATA_LENGTH`,0)`DATA_LENGTH`,coalesce(`INDEX_LENGTH`,0)`INDEX_LENGTH`"+
+		"from`information_schema`.`TABLES`"+
+		"where`TABLE_SCHEMA`=database()"+
+		"and`TABLE_NAME`like @@like "+
+		"order by`TABLE_NAME`", 0, mysql.Params{
+		"like": like,
+	})
+	if err != nil {
+		return err
+	}
+
+	var triggers []leftoverTrigger
+	err = db.Select(&triggers, "select`TRIGGER_NAME`,`EVENT_OBJECT_TABLE`,`EVENT_MANIPULATION`,`ACTION_STATEMENT`"+
+		"from`information_schema`.`TRIGGERS`"+
+		"where`TRIGGER_SCHEMA`=database()"+
+		"and`TRIGGER_NAME`like @@like "+
+		"order by`EVENT_OBJECT_TABLE`,`TRIGGER_NAME`", 0, mysql.Params{
+		"like": like,
+	})
+	if err != nil {
+		return err
+	}
+
+	i := 0
+	for _, t := range tables {
+		if !strings.HasSuffix(t.TableName, suffix) {
+			continue
+		}
+		if len(tableName) != 0 && t.TableName != tableName+suffix {
+			continue
+		}
+		tables[i] = t
+		i++
+	}
+	tables = tables[:i]
+
+	i = 0
+	for _, t := range triggers {
+		if !strings.HasSuffix(t.TriggerName, suffix) {
+			continue
+		}
+		if len(tableName) != 0 && t.TableName != tableName {
+			continue
+		}
+		triggers[i] = t
+		i++
+	}
+	triggers = triggers[:i]
+
+	if len(tables) == 0 && len(triggers) == 0 {
+		log.Println("nothing to clean up")
+		return nil
+	}
+
+	if len(triggers) != 0 {
+		fmt.Println(color.HiBlueString("triggers:"))
+		for _, t := range triggers {
+			fmt.Printf("  %s on %s (after %s)\n", color.HiCyanString(t.TriggerName), t.TableName, strings.ToLower(t.Event))
+			for _, line := range strings.Split(t.Statement, "\n") {
+				fmt.Println("    " + line)
+			}
+		}
+	}
+
+	if len(tables) != 0 {
+		fmt.Println(color.HiBlueString("tables:"))
+		for _, t := range tables {
+			fmt.Printf("  %s ~%d rows, %s\n", color.HiCyanString(t.TableName), t.TableRows, formatBytes(t.DataLength+t.IndexLength))
+		}
+	}
+
+	if !yesNo(fmt.Sprintf("drop these %d triggers and %d tables?", len(triggers), len(tables))) {
+		return nil
+	}
+
+	for _, t := range triggers {
+		log.Println("dropping trigger", t.TriggerName)
+		err := db.Exec("drop trigger if exists`" + t.TriggerName + "`")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range tables {
+		log.Println("dropping table", t.TableName)
+		err := db.Exec("drop table if exists`" + t.TableName + "`")
+		if err != nil {
+			return err
+		}
+
+		// a run can't be resumed without its temp table,
+		// so there's no reason to keep its state around
+		st := &state{file: stateFile(dbDSN, strings.TrimSuffix(t.TableName, suffix))}
+		if err := st.remove(); err != nil {
+			log.Println(color.YellowString("failed to remove state: %v", err))
+		}
+	}
+
+	return nil
+}
+
+// formatBytes formats a number of bytes the way people like to read them
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
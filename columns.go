@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"strings"
 
 	mysql "github.com/StirlingMarketingGroup/cool-mysql"
@@ -15,7 +17,12 @@ type column struct {
 	DataType             string `mysql:"DATA_TYPE"`
 	ColumnType           string `mysql:"COLUMN_TYPE"`
 	GenerationExpression string `mysql:"GENERATION_EXPRESSION"`
+	CharacterSetName     string `mysql:"CHARACTER_SET_NAME"`
 	PrimaryKey           bool
+
+	// PrimaryKeySeq is where the column is in the primary key, starting at 1,
+	// which isn't always where it is in the table
+	PrimaryKeySeq int
 }
 
 func getTableColumns(db *mysql.Database, tableName string) ([]column, error) {
@@ -23,7 +30,7 @@ func getTableColumns(db *mysql.Database, tableName string) ([]column, error) {
 
 	// we need to check to see if the db supports generated columns
 	// if it doesn't, our query to get column info will fail
-	columnInfoCols := "`COLUMN_NAME`,`ORDINAL_POSITION`,`DATA_TYPE`,`COLUMN_TYPE`"
+	columnInfoCols := "`COLUMN_NAME`,`ORDINAL_POSITION`,`DATA_TYPE`,`COLUMN_TYPE`,ifnull(`CHARACTER_SET_NAME`,'')`CHARACTER_SET_NAME`"
 	ok, err := db.Exists("select 0 "+
 		"from`information_schema`.`columns`"+
 		"where lower(`TABLE_SCHEMA`)='information_schema'"+
@@ -47,27 +54,36 @@ func getTableColumns(db *mysql.Database, tableName string) ([]column, error) {
 		return nil, err
 	}
 
-	var primaryKeys []struct {
-		ColumnName string `mysql:"Column_name"`
-	}
+	var primaryKeys []primaryKeyColumn
 	err = db.Select(&primaryKeys, "show index from`"+tableName+"`where`Key_name`='PRIMARY'", 0)
 	if err != nil {
 		return nil, err
 	}
+	setPrimaryKey(columns, primaryKeys)
+
+	return columns, nil
+}
+
+// primaryKeyColumn is a column of the primary key, as "show index" has it
+type primaryKeyColumn struct {
+	ColumnName string `mysql:"Column_name"`
+	SeqInIndex int    `mysql:"Seq_in_index"`
+}
 
-	primaryKeysSet := make(map[string]struct{}, len(primaryKeys))
+// setPrimaryKey marks which of the columns are in the primary key, and where
+func setPrimaryKey(columns []column, primaryKeys []primaryKeyColumn) {
+	seqs := make(map[string]int, len(primaryKeys))
 	for _, pk := range primaryKeys {
-		primaryKeysSet[pk.ColumnName] = struct{}{}
+		seqs[pk.ColumnName] = pk.SeqInIndex
 	}
 
 	for i := range columns {
 		c := &columns[i]
-		if _, ok := primaryKeysSet[c.ColumnName]; ok {
+		if seq, ok := seqs[c.ColumnName]; ok {
 			c.PrimaryKey = true
+			c.PrimaryKeySeq = seq
 		}
 	}
-
-	return columns, nil
 }
 
 func quoteColumns(columns []column) string {
@@ -93,14 +109,6 @@ func quoteColumnsPrefix(columns []column, prefix string) string {
 	return columnsQuotedBld.String()
 }
 
-func columnsSet(columns []column) map[string]struct{} {
-	set := make(map[string]struct{}, len(columns))
-	for _, c := range columns {
-		set[c.ColumnName] = struct{}{}
-	}
-	return set
-}
-
 func columnNames(columns []column) []string {
 	names := make([]string, len(columns))
 	for i, c := range columns {
@@ -108,3 +116,106 @@ func columnNames(columns []column) []string {
 	}
 	return names
 }
+
+// getConnTableColumns gets the columns of a table through a single connection,
+// using "show columns" instead of the information schema. This is needed for
+// temporary tables, which only exist for the connection that made them and
+// never show up in the information schema
+func getConnTableColumns(ctx context.Context, conn *sql.Conn, tableName string) ([]column, error) {
+	rows, err := conn.QueryContext(ctx, "show columns from`"+tableName+"`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []column
+	for rows.Next() {
+		var field, columnType, null, key, extra string
+		var def sql.NullString
+		err := rows.Scan(&field, &columnType, &null, &key, &def, &extra)
+		if err != nil {
+			return nil, err
+		}
+
+		// the data type is just the column type without
+		// its lengths or flags, like "int" from "int(10) unsigned"
+		dataType := columnType
+		if i := strings.IndexAny(dataType, "( "); i != -1 {
+			dataType = dataType[:i]
+		}
+
+		c := column{
+			ColumnName: field,
+			Position:   len(columns) + 1,
+			DataType:   strings.ToLower(dataType),
+			ColumnType: columnType,
+			PrimaryKey: key == "PRI",
+		}
+
+		// we don't get the actual expression here, but we only ever
+		// care whether a column is generated or not, so the extra info
+		// like "VIRTUAL GENERATED" is good enough to stand in for it.
+		// Careful not to match "DEFAULT_GENERATED" though, which is just
+		// a column with an expression as its default
+		extra = strings.ToUpper(extra)
+		if strings.Contains(extra, "VIRTUAL GENERATED") || strings.Contains(extra, "STORED GENERATED") {
+			c.GenerationExpression = extra
+		}
+
+		columns = append(columns, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// show columns only says which columns are in the primary key, not in what order
+	indexRows, err := conn.QueryContext(ctx, "show index from`"+tableName+"`where`Key_name`='PRIMARY'")
+	if err != nil {
+		return nil, err
+	}
+	defer indexRows.Close()
+
+	cols, err := indexRows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var primaryKeys []primaryKeyColumn
+	for indexRows.Next() {
+		var pk primaryKeyColumn
+		dest := make([]any, len(cols))
+		for i, name := range cols {
+			switch name {
+			case "Column_name":
+				dest[i] = &pk.ColumnName
+			case "Seq_in_index":
+				dest[i] = &pk.SeqInIndex
+			default:
+				dest[i] = new(sql.RawBytes)
+			}
+		}
+		err := indexRows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		primaryKeys = append(primaryKeys, pk)
+	}
+	if err := indexRows.Err(); err != nil {
+		return nil, err
+	}
+	setPrimaryKey(columns, primaryKeys)
+
+	return columns, nil
+}
+
+// columnsSignature describes each column by its name and full type,
+// which is what we use to tell if a table has changed
+func columnsSignature(columns []column) []string {
+	signature := make([]string, len(columns))
+	for i, c := range columns {
+		signature[i] = "`" + c.ColumnName + "` " + c.ColumnType
+		if c.PrimaryKey {
+			signature[i] += " primary key"
+		}
+	}
+	return signature
+}
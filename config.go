@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config is the general settings file that lives next to the
+// connections file, for everything that isn't a connection
+type config struct {
+	// Editor is the command used to edit the alter query
+	// when neither $VISUAL nor $EDITOR are set, like "vim" or "code --wait"
+	Editor string `yaml:"editor"`
+}
+
+// conf is our loaded config, and is just the zero value
+// if the user doesn't have a config file, which is perfectly fine
+var conf config
+
+// getConfig returns our config that's parsed from
+// the given file, usually in the user's config dir
+func getConfig(file string) (c config, err error) {
+	y, err := os.ReadFile(file)
+	if err != nil {
+		return c, err
+	}
+	err = yaml.Unmarshal(y, &c)
+	if err != nil {
+		return c, err
+	}
+
+	return
+}
@@ -14,6 +14,14 @@ type connection struct {
 	Host   string            `yaml:"host"`
 	Schema string            `yaml:"schema"`
 	Params map[string]string `yaml:"params"`
+
+	// Replicas are the names of other connections (or DSNs)
+	// that replicate from this one, and are watched with -max-lag
+	Replicas []string `yaml:"replicas"`
+
+	// SQLMode is the sql_mode rows are copied and sync triggers
+	// are made with, unless it's given with -sql-mode
+	SQLMode string `yaml:"sql_mode"`
 }
 
 // getConnections returns our connection map that's
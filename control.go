@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+)
+
+// controlSocketFile is the default path of the control socket for a table. Unix socket
+// paths can't be very long, so it goes in the temp dir instead of next to our state
+func controlSocketFile(dsn string, tableName string) string {
+	return filepath.Join(os.TempDir(), "smgla-"+strings.TrimSuffix(filepath.Base(stateFile(dsn, tableName)), ".json")+".sock")
+}
+
+// controller answers the commands sent to our control socket, one per line,
+// so that a long copy can be looked at and tuned without stopping it, ex:
+//
+//	echo status | nc -U /tmp/smgla-127.0.0.1_3306-cooldb-orders.sock
+type controller struct {
+	listener net.Listener
+
+	g   *guard
+	t   *throttler
+	bar *mpb.Bar
+
+	mu        sync.Mutex
+	postponed bool
+}
+
+// listenControl starts listening on the control socket, replacing
+// anything a run that didn't get the chance to clean up left behind
+func listenControl(path string, g *guard, t *throttler) (*controller, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &controller{
+		listener:  l,
+		g:         g,
+		t:         t,
+		postponed: *postponeCutover,
+	}
+	go c.serve()
+
+	log.Println("listening for commands on", path)
+
+	return c, nil
+}
+
+func (c *controller) serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			// closed
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *controller) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		reply, err := c.command(line)
+		if err != nil {
+			reply = "error: " + err.Error()
+		}
+		fmt.Fprintln(conn, reply)
+	}
+}
+
+// command runs a single command and returns what to reply with
+func (c *controller) command(line string) (string, error) {
+	name, value, _ := strings.Cut(line, "=")
+
+	switch name {
+	case "status":
+		return c.status(), nil
+
+	case "pause":
+		c.t.pause()
+		return "paused", nil
+
+	case "resume":
+		c.t.resume()
+		return "resumed", nil
+
+	case "chunk-time":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return "", fmt.Errorf("chunk-time needs a duration, ex: chunk-time=250ms")
+		}
+		c.t.setChunkTime(d)
+		log.Println("chunk time set to", d, "from the control socket")
+		return "chunk-time=" + d.String(), nil
+
+	case "max-rows-per-sec":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("max-rows-per-sec needs a number, or 0 for no limit, ex: max-rows-per-sec=5000")
+		}
+		c.t.setMaxRowsPerSec(n)
+		log.Println("max rows per second set to", n, "from the control socket")
+		return "max-rows-per-sec=" + strconv.FormatInt(n, 10), nil
+
+	case "abort":
+		c.g.abortWith(errors.New("aborted from the control socket"))
+		return "aborting", nil
+
+	case "postpone-cutover":
+		c.setPostponed(true)
+		log.Println("cutover postponed from the control socket")
+		return "cutover postponed", nil
+
+	case "unpostpone":
+		c.setPostponed(false)
+		log.Println("cutover unpostponed from the control socket")
+		return "cutover unpostponed", nil
+	}
+
+	return "", fmt.Errorf("unknown command %q, try status, pause, resume, chunk-time=250ms, max-rows-per-sec=5000, abort, postpone-cutover, or unpostpone", name)
+}
+
+func (c *controller) status() string {
+	bld := new(strings.Builder)
+
+	c.mu.Lock()
+	bar := c.bar
+	postponed := c.postponed
+	c.mu.Unlock()
+
+	if bar != nil {
+		fmt.Fprintf(bld, "copied: %d\n", bar.Current())
+	}
+	if reason := c.t.status(); len(reason) != 0 {
+		fmt.Fprintf(bld, "paused: %s\n", reason)
+	} else {
+		bld.WriteString("paused: no\n")
+	}
+
+	c.t.mu.Lock()
+	fmt.Fprintf(bld, "chunk-time: %s\n", c.t.chunkTime)
+	fmt.Fprintf(bld, "max-rows-per-sec: %d\n", c.t.maxRowsPerSec)
+	c.t.mu.Unlock()
+
+	fmt.Fprintf(bld, "cutover postponed: %t", postponed)
+
+	return bld.String()
+}
+
+// setBar lets status report how many rows have been copied
+func (c *controller) setBar(bar *mpb.Bar) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bar = bar
+}
+
+func (c *controller) setPostponed(postponed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.postponed = postponed
+}
+
+func (c *controller) isPostponed() bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.postponed
+}
+
+// waitUnpostponed blocks until the cutover is unpostponed, or we're aborted
+func (c *controller) waitUnpostponed() error {
+	log.Println(color.YellowString("the copy is done, but the cutover is postponed, send unpostpone to the control socket to do it"))
+	for c.isPostponed() {
+		if c.g.isAborted() {
+			return c.g.abortErr()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// close stops listening and removes the socket
+func (c *controller) close() {
+	if c == nil {
+		return
+	}
+	c.listener.Close()
+}
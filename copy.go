@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	dynamicstruct "github.com/Ompluscator/dynamic-struct"
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+)
+
+// checkpointInterval is how often we save our checkpoint while copying,
+// since saving after every single chunk would be a lot of pointless writes
+const checkpointInterval = time.Second
+
+// initialReadChunkSize is how many rows the first select of the client side copy reads,
+// and it's adjusted after every chunk to hit our target chunk time
+const initialReadChunkSize = 1000
+
+// resizeChunk is the size of the next chunk, given how long a chunk of size took.
+// If the last chunk took too long, we drop the chunk size immediately,
+// but if the chunk finished faster than target time then increase the chunk size,
+// but only by 10% of the difference, allowing for a steady increase
+func resizeChunk(size int, took, target time.Duration) int {
+	ratio := int(float64(size) * float64(target) / float64(took))
+	if took > target {
+		size = ratio
+	} else {
+		size += (ratio - size) / 10
+	}
+	return max(size, 1)
+}
+
+// copyRows copies a range of rows from the original table into our temp table, starting
+// right after the range's checkpoint, and keeps the checkpoint up to date as rows make
+// it into the temp table. Both the select and the inserts wait on the throttler before
+// every chunk. The inserts resize their chunks by changing db's max insert size,
+// so every range being copied at the same time needs a db of its own
+func copyRows(db *mysql.Database, p *plan, st *state, r *keyRange, bar *mpb.Bar, g *guard, t *throttler) error {
+	// the raw transport can take any type of column, since mysql
+	// does all the work of turning each value into a literal
+	var newRowStruct dynamicstruct.Builder
+	var pkIndexes []int
+	var selectColumns string
+	var err error
+	if *transport == "raw" {
+		newRowStruct, pkIndexes = rawRowStruct(p.newColumns)
+		selectColumns = p.rawSelectColumns()
+	} else {
+		newRowStruct, pkIndexes, err = tableRowStruct(p.newColumns)
+		if err != nil {
+			return err
+		}
+		selectColumns = p.selectColumns()
+	}
+	p.sortPrimaryKeyFields(pkIndexes)
+
+	// this gets the "type" of our struct from our dynamic struct
+	structType := reflect.ValueOf(newRowStruct.Build().New()).Elem().Type()
+	// and then we make a channel with reflection for our new type of struct
+	chRef := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, structType), *rowBufferSize)
+
+	// the inserts get their rows from this one instead, with nothing buffered,
+	// so that we know exactly when a row leaves our buffer
+	insRef := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, structType), 0)
+	ch := insRef.Interface()
+
+	// besides the number of rows, our buffer is limited by the size of the rows in it,
+	// since a few hundred rows with big blobs can take up a lot of memory. A single row
+	// bigger than the limit still goes through, but only once the buffer is empty
+	var bufMu sync.Mutex
+	bufCond := sync.NewCond(&bufMu)
+	var buffered int
+	var bufferedSizes []int
+
+	// the primary key values of every row handed to the inserts, in order,
+	// so that a warning about a row of an insert can say which row it was
+	var keysMu sync.Mutex
+	var keys [][]any
+
+	go func() {
+		defer insRef.Close()
+
+		for {
+			row, ok := chRef.Recv()
+			if !ok {
+				return
+			}
+
+			key := make([]any, len(pkIndexes))
+			for i, field := range pkIndexes {
+				key[i] = row.Field(field).Interface()
+			}
+			keysMu.Lock()
+			keys = append(keys, key)
+			keysMu.Unlock()
+
+			insRef.Send(row)
+
+			bufMu.Lock()
+			buffered -= bufferedSizes[0]
+			bufferedSizes = bufferedSizes[1:]
+			bufCond.Broadcast()
+			bufMu.Unlock()
+		}
+	}()
+
+	prevIDs := make([]any, len(pkIndexes))
+
+	var exists bool
+	sent := r.Copied
+
+	// waiting on our buffer isn't the select's fault, so it's left out of how long it took
+	var blocked time.Duration
+	destFunc := reflect.MakeFunc(reflect.FuncOf([]reflect.Type{structType}, nil, false),
+		func(args []reflect.Value) (results []reflect.Value) {
+			size := rowSize(args[0])
+
+			blockedStart := time.Now()
+			bufMu.Lock()
+			for buffered != 0 && buffered+size > *bufferBytes {
+				bufCond.Wait()
+			}
+			buffered += size
+			bufferedSizes = append(bufferedSizes, size)
+			bufMu.Unlock()
+
+			chRef.Send(args[0])
+			blocked += time.Since(blockedStart)
+
+			exists = true
+			sent++
+
+			for i, field := range pkIndexes {
+				prevIDs[i] = args[0].Field(field).Interface()
+			}
+
+			return nil
+		})
+
+	// a row being selected doesn't mean it's been inserted yet, since it could
+	// still be waiting in our channel, so after every select chunk we remember
+	// how many rows had been sent by then and what the last primary key values
+	// were, and only once that many rows have been inserted is it a safe checkpoint
+	type pendingCheckpoint struct {
+		sent       int64
+		checkpoint string
+	}
+	var pendingMu sync.Mutex
+	var pending []pendingCheckpoint
+
+	inserted := r.Copied
+	safeCheckpoint := r.Checkpoint
+	lastSave := time.Now()
+
+	// the select runs in its own goroutine, so if it fails it
+	// stops sending rows, and we return its error once the inserts are done
+	var selectErr error
+
+	go func() {
+		defer chRef.Close()
+
+		checkpoint := r.Checkpoint
+		size := initialReadChunkSize
+
+		for {
+			t.wait(g)
+			if g.isAborted() {
+				selectErr = g.abortErr()
+				break
+			}
+
+			chunkStart := time.Now()
+			chunkSent := sent
+			blocked = 0
+
+			exists = false
+			query, err := p.chunkSelectQuery(db, selectColumns, p.rangeWhere(checkpoint, r.End), size)
+			if err == nil {
+				err = db.Select(destFunc.Interface(), query, 0)
+			}
+			if err != nil {
+				selectErr = fmt.Errorf("failed to execute main select: %w", err)
+				break
+			}
+
+			if !exists {
+				break
+			}
+
+			checkpoint, _, err = db.InterpolateParams("@@prevIDs", mysql.Params{
+				"prevIDs": prevIDs,
+			})
+			if err != nil {
+				selectErr = fmt.Errorf("failed to build checkpoint: %w", err)
+				break
+			}
+
+			pendingMu.Lock()
+			pending = append(pending, pendingCheckpoint{sent: sent, checkpoint: checkpoint})
+			pendingMu.Unlock()
+
+			// a chunk cut short by the end of the range says nothing about how
+			// long a full one would take, and it's our last one anyway
+			if took := time.Since(chunkStart) - blocked; sent-chunkSent == int64(size) && took > 0 {
+				size = resizeChunk(size, took, t.targetChunkTime())
+			}
+
+			t.limit(sent-chunkSent, chunkStart)
+		}
+	}()
+
+	chunkStartTime := time.Now()
+
+	originalMaxInsertSize := db.MaxInsertSize.Get()
+
+	// the warnings of the last insert, by the row of the insert they're
+	// about, which are reported as its rows come through one at a time
+	var chunkCoercions map[int][]coercion
+	var chunkRow int
+
+	// start the import!
+	// Now this *does* have to be chunked because there's no way to stream
+	// rows to mysql, but cool mysql handles this for us, all it needs is the same
+	// channel we got from the select
+	err = db.I().SetAfterChunkExec(func(start time.Time) {
+		// our db reads the warnings of its writes right after each one,
+		// so these are the warnings of the insert that just ran
+		coercions, err := showWarnings(db)
+		if err != nil {
+			log.Println(color.YellowString("failed to check for changed values: %v", err))
+		}
+		chunkCoercions = make(map[int][]coercion)
+		chunkRow = 0
+		for _, c := range coercions {
+			if c.row == 0 {
+				reportCoercion(c, "")
+				continue
+			}
+			chunkCoercions[c.row] = append(chunkCoercions[c.row], c)
+		}
+
+		// this can be changed from the control socket while we're running
+		targetChunkTime := t.targetChunkTime()
+
+		chunkTime := time.Since(chunkStartTime)
+		if chunkTime > targetChunkTime {
+			db.MaxInsertSize.Set(int(float64(db.MaxInsertSize.Get()) * float64(targetChunkTime) / float64(chunkTime)))
+		} else {
+			current := db.MaxInsertSize.Get()
+			ratio := int(float64(db.MaxInsertSize.Get()) * float64(targetChunkTime) / float64(chunkTime))
+
+			addl := ratio - current
+			newMaxInsertSize := current + addl/10
+
+			if newMaxInsertSize <= originalMaxInsertSize {
+				// if the last chunk took too long, we drop the insert chunk size immediately,
+				// but if the chunk inserted faster than target time then increase the chunk size,
+				// but only by 10% of the difference, allowing for a steady increase
+				db.MaxInsertSize.Set(current + addl/10)
+			}
+		}
+
+		// waiting here holds up the rest of the rows, and since it's before
+		// we start timing the next chunk, a pause doesn't shrink our chunks
+		t.wait(g)
+		chunkStartTime = time.Now()
+	}).SetAfterRowExec(func(start time.Time) {
+		bar.Increment()
+		bar.DecoratorEwmaUpdate(time.Since(start))
+
+		keysMu.Lock()
+		key := keys[0]
+		keys = keys[1:]
+		keysMu.Unlock()
+
+		chunkRow++
+		if coercions := chunkCoercions[chunkRow]; len(coercions) != 0 {
+			k, _, _ := db.InterpolateParams("@@key", mysql.Params{
+				"key": key,
+			})
+			for _, c := range coercions {
+				reportCoercion(c, k)
+			}
+		}
+
+		// this is only called once the row's chunk has been executed,
+		// so every row counted here is safely in our temp table
+		pendingMu.Lock()
+		inserted++
+		for len(pending) != 0 && pending[0].sent <= inserted {
+			safeCheckpoint = pending[0].checkpoint
+			pending = pending[1:]
+		}
+		pendingMu.Unlock()
+
+		if time.Since(lastSave) >= checkpointInterval {
+			lastSave = time.Now()
+			if err := st.checkpoint(r, safeCheckpoint, inserted); err != nil {
+				log.Println(color.YellowString("failed to save checkpoint: %v", err))
+			}
+		}
+	}).Insert("insert ignore into`"+p.tempTableName+"`", ch)
+	if err != nil {
+		// the select is probably still blocked trying to send us rows,
+		// so we tell it to stop and drain whatever it's still sending
+		g.abortWith(err)
+		for {
+			if _, ok := insRef.Recv(); !ok {
+				break
+			}
+		}
+		return err
+	}
+	if selectErr != nil {
+		return selectErr
+	}
+
+	// everything has been inserted, so whatever the last
+	// checkpoint was is now safe no matter how many rows are pending
+	pendingMu.Lock()
+	if len(pending) != 0 {
+		safeCheckpoint = pending[len(pending)-1].checkpoint
+	}
+	pendingMu.Unlock()
+
+	return st.finishRange(r, safeCheckpoint, inserted)
+}
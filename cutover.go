@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+)
+
+// checkCopy maps the columns of our plan the same way the run that made the temp table
+// did, and makes sure the temp table and triggers are still exactly how it left them
+func checkCopy(db *mysql.Database, p *plan, st *state) error {
+	oldColumns, err := getTableColumns(db, p.tableName)
+	if err != nil {
+		return err
+	}
+
+	newColumns, err := getTableColumns(db, p.tempTableName)
+	if err != nil {
+		return err
+	}
+	if len(newColumns) == 0 {
+		return fmt.Errorf("temp table %q is missing", p.tempTableName)
+	}
+
+	err = p.mapColumns(oldColumns, newColumns)
+	if err != nil {
+		return err
+	}
+
+	err = st.matches(p)
+	if err != nil {
+		return err
+	}
+
+	return checkSyncTriggers(db, p)
+}
+
+// cutoverCommand does the cutover for a copy made by the copy command (or by an alter
+// that was told not to do the drop/swap), once it's made sure that the temp table and
+// triggers are still intact, since it's been up to them to keep the copy current
+func cutoverCommand(db *mysql.Database, dbDSN string, tableName string) (err error) {
+	start := time.Now()
+
+	if len(tableName) == 0 {
+		return errors.New("cutover needs the table being altered, ex: smg-live-alter cutover localhost orders")
+	}
+
+	st, err := loadState(stateFile(dbDSN, tableName))
+	if err != nil {
+		return err
+	}
+	if st.Finished.IsZero() {
+		return fmt.Errorf("the copy of %q hasn't finished, finish it with \"smg-live-alter copy -resume <connection> %s\"", tableName, tableName)
+	}
+
+	_, alterPart, err := parseAlter(st.Alter)
+	if err != nil {
+		return err
+	}
+
+	p, err := newPlan(db, tableName, alterPart)
+	if err != nil {
+		return err
+	}
+	if *atomicCutover || keepingOld() {
+		err = p.checkSwap()
+		if err != nil {
+			return fmt.Errorf("-atomic-cutover, -keep-old, and -reverse-sync can't be used here: %w", err)
+		}
+	}
+
+	err = checkCopy(db, p, st)
+	if err != nil {
+		return fmt.Errorf("can't cutover: %w", err)
+	}
+
+	log.Printf("the copy of %s finished %s ago, and is intact", tableName, time.Since(st.Finished).Round(time.Second))
+
+	// the copy is worth keeping even if the cutover never gets going, so there's
+	// nothing for the guard to roll back, but it still does the rest of its job
+	g := newGuard(db, p)
+	g.st = st
+	g.watchSignals()
+	defer func() {
+		if err != nil {
+			g.fail(err)
+		}
+	}()
+
+	if !yesNo("do the drop/swap?") {
+		g.finish()
+		return nil
+	}
+
+	err = runCutover(db, dbDSN, p, st, g)
+	if err != nil {
+		return err
+	}
+
+	log.Println("finished the cutover of", tableName, "in", time.Since(start))
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+)
+
+// errNoTemporaryTable is what planColumnsDry fails with when it can't make its temporary table,
+// which leaves the columns unknown, but doesn't stop the rest of the runbook from being written
+var errNoTemporaryTable = errors.New("failed to create temporary table")
+
+// planColumnsDry fills in the plan's columns without writing anything, and returns
+// the altered table's creation statement, for the indexes -deferred-indexes would drop.
+// Since we need the altered table's columns, and those only exist once the alter
+// has actually been applied to something, we apply it to a temporary table
+// instead, which disappears with the connection and is never seen by anyone else
+func planColumnsDry(db *mysql.Database, p *plan) (string, error) {
+	oldColumns, err := getTableColumns(db, p.tableName)
+	if err != nil {
+		return "", err
+	}
+
+	// temporary tables belong to the connection that made them,
+	// so everything here has to happen on this one connection
+	ctx := context.Background()
+	conn, err := db.Writes.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	log.Println("creating temporary temp table")
+	_, err = conn.ExecContext(ctx, "CREATE TEMPORARY TABLE"+strings.TrimPrefix(p.createTempTable, "CREATE TABLE"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errNoTemporaryTable, err)
+	}
+	defer conn.ExecContext(ctx, "drop temporary table if exists`"+p.tempTableName+"`")
+
+	log.Println("applying alter to temporary temp table")
+	_, err = conn.ExecContext(ctx, p.alterTempTableSQL())
+	if err != nil {
+		return "", fmt.Errorf("failed to apply alter to temporary table: %w", err)
+	}
+
+	newColumns, err := getConnTableColumns(ctx, conn, p.tempTableName)
+	if err != nil {
+		return "", err
+	}
+
+	var createMySQL string
+	err = conn.QueryRowContext(ctx, "show create table`"+p.tempTableName+"`").Scan(new(string), &createMySQL)
+	if err != nil {
+		return "", err
+	}
+
+	return createMySQL, p.mapColumns(oldColumns, newColumns)
+}
+
+// dryRun writes every statement the alter would run as a SQL runbook, without running any
+// of them. The runbook can be run as-is with the mysql client, although it copies all the
+// rows in one statement instead of in chunks the way we do
+func dryRun(db *mysql.Database, p *plan, alterQuery string, w io.Writer) error {
+	// without the CREATE TEMPORARY TABLES privilege, we can't find out the altered table's
+	// columns, but everything that doesn't need them is still worth seeing
+	createMySQL, err := planColumnsDry(db, p)
+	unknown := errors.Is(err, errNoTemporaryTable)
+	if unknown {
+		log.Println(color.YellowString("%v, so the altered table's columns are unknown", err))
+	} else if err != nil {
+		return err
+	}
+	var deferred, deferredNames []string
+	if *deferredIndexes {
+		deferred, deferredNames = deferrableIndexes(createMySQL)
+	}
+
+	log.Println("getting original triggers")
+	triggers, err := getTriggers(db, p.tableName)
+	if err != nil {
+		return err
+	}
+
+	mode, err := copySQLMode(db, p, nil)
+	if err != nil {
+		return err
+	}
+
+	bld := new(strings.Builder)
+	comment := func(s string) {
+		for _, line := range strings.Split(s, "\n") {
+			bld.WriteString("-- ")
+			bld.WriteString(line)
+			bld.WriteByte('\n')
+		}
+	}
+	statement := func(s string) {
+		bld.WriteString(s)
+		bld.WriteString(";\n")
+	}
+	// triggers have semicolons in their bodies, so the mysql client needs
+	// a different delimiter to know where each of them ends
+	delimited := func(statements ...string) {
+		bld.WriteString("DELIMITER $$\n")
+		for _, s := range statements {
+			bld.WriteString(s)
+			bld.WriteString("$$\n")
+		}
+		bld.WriteString("DELIMITER ;\n")
+	}
+
+	comment("smg-live-alter dry run, generated " + time.Now().Format(time.RFC3339))
+	comment(alterQuery)
+
+	bld.WriteString("\n")
+	comment("create the temp table, without its constraints")
+	statement("drop table if exists`" + p.tempTableName + "`")
+	statement(p.createTempTable)
+	statement(p.alterTempTableSQL())
+
+	if *deferredIndexes {
+		bld.WriteString("\n")
+		switch {
+		case unknown:
+			comment("the secondary indexes are dropped here, and added back once the rows are copied, but")
+			comment("which of them can be is unknown, since the temporary table couldn't be created")
+		case len(deferred) != 0:
+			comment("the secondary indexes are dropped until the rows are copied")
+			statement(dropIndexesSQL(p.tempTableName, deferredNames))
+		}
+	}
+
+	if len(p.constraints) != 0 {
+		bld.WriteString("\n")
+		comment("constraints stripped from the temp table, these are added back during the cutover")
+		comment(strings.TrimLeft(p.constraints, ",\n"))
+	}
+
+	bld.WriteString("\n")
+	comment("the triggers are made, and the rows are copied, in utc and in a sql_mode that")
+	comment("lets in the rows that are already in the original table. Triggers keep the")
+	comment("sql_mode they were made with")
+	statement("set time_zone='+00:00',sql_mode='" + mode + "'")
+
+	if unknown {
+		bld.WriteString("\n")
+		comment("the triggers that keep the temp table in sync, and the copy of the rows, both need")
+		comment("the altered table's columns, which are unknown, since the temporary table couldn't be")
+		comment("created. Run again with the CREATE TEMPORARY TABLES privilege to see them")
+	} else {
+		bld.WriteString("\n")
+		comment("triggers that keep the temp table in sync while the rows are copied")
+		helperTriggers := p.triggers()
+		statements := make([]string, 0, len(helperTriggers)*2)
+		for _, t := range helperTriggers {
+			statements = append(statements, "drop trigger if exists`"+t.name+"`", t.createSQL())
+		}
+		delimited(statements...)
+
+		bld.WriteString("\n")
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(p.oldPrimaryColumns)), ",")
+		nextWhere := p.rangeWhere(placeholders, "")
+		switch *copyEngine {
+		case "client":
+			firstSelect, err := p.copySelectQuery(db, "", initialReadChunkSize)
+			if err != nil {
+				return err
+			}
+			nextSelect, err := p.copySelectQuery(db, nextWhere, initialReadChunkSize)
+			if err != nil {
+				return err
+			}
+			comment("copy the rows. smg-live-alter reads these in chunks ordered by the primary key, starting with")
+			comment("  " + firstSelect)
+			comment("and then for every chunk after, with the last primary key values of the chunk before")
+			comment("  " + nextSelect)
+		case "load-data":
+			nextSelect, err := p.chunkSelectQuery(db, p.loadDataSelectColumns(), nextWhere, initialServerChunkSize)
+			if err != nil {
+				return err
+			}
+			comment("copy the rows. smg-live-alter reads these in chunks ordered by the primary key, with")
+			comment("the last primary key values of the chunk before, and n rows at a time")
+			comment("  " + nextSelect)
+			comment("and streams each chunk right back with")
+			comment("  " + p.loadDataQuery("<chunk>"))
+		default:
+			comment("copy the rows. smg-live-alter copies these in chunks ordered by the primary key, finding")
+			comment("the end of each chunk of n rows after the last primary key values of the chunk before with")
+			comment("  " + p.chunkBoundQuery(nextWhere, initialServerChunkSize))
+			comment("and copying up to it with")
+			comment("  " + p.insertSelectQuery(p.rangeWhere(placeholders, placeholders)))
+		}
+		statement(p.insertSelectQuery(""))
+
+		if len(deferred) != 0 {
+			bld.WriteString("\n")
+			comment("the secondary indexes are added back all at once, now that the rows are copied")
+			statement(addIndexesSQL(p.tempTableName, deferred))
+		}
+	}
+
+	bld.WriteString("\n")
+	comment("the cutover")
+	statement("set foreign_key_checks=0")
+	steps, err := p.planCutover(db, triggers)
+	if err != nil {
+		return err
+	}
+	// the reverse sync triggers need the columns just like ours do
+	var reverseTriggers []string
+	if unknown && *reverseSync > 0 {
+		comment("the reverse sync triggers are left out, since the altered table's columns are unknown")
+		for _, t := range p.reverseTriggers() {
+			reverseTriggers = append(reverseTriggers, t.name)
+		}
+	}
+	statements := make([]string, 0, len(steps))
+	for _, s := range steps {
+		if s.Kind == stepTrigger && slices.Contains(reverseTriggers, s.Names[0]) {
+			continue
+		}
+		statements = append(statements, s.Query)
+	}
+	delimited(statements...)
+
+	_, err = io.WriteString(w, bld.String())
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+)
+
+// checkKeysetPlan makes sure mysql reads our chunks as a range of the primary key before
+// we start copying, because a chunk read any other way has to get through every row
+// before it, making every chunk slower than the last. It explains the chunk query
+// of our copy engine for the rows after the first row of the table
+func checkKeysetPlan(db *mysql.Database, p *plan) error {
+	var first []struct {
+		Bound string
+	}
+	err := db.Select(&first, p.chunkBoundQuery("", 1), 0)
+	if err != nil {
+		return err
+	}
+	if len(first) == 0 {
+		return nil
+	}
+
+	where := p.rangeWhere(first[0].Bound, "")
+
+	// a table that fits in a chunk can be read however mysql likes,
+	// and mysql likes to scan tables that small
+	var next []struct {
+		Bound string
+	}
+	err = db.Select(&next, p.chunkBoundQuery(where, initialServerChunkSize), 0)
+	if err != nil {
+		return err
+	}
+	if len(next) == 0 {
+		return nil
+	}
+
+	query := p.chunkBoundQuery(where, initialServerChunkSize)
+	switch *copyEngine {
+	case "client":
+		query, err = p.copySelectQuery(db, where, initialReadChunkSize)
+	case "load-data":
+		query, err = p.chunkSelectQuery(db, p.loadDataSelectColumns(), where, initialServerChunkSize)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("checking that chunks are read by primary key")
+	var rows []struct {
+		Table *string `mysql:"table"`
+		Type  *string `mysql:"type"`
+		Key   *string `mysql:"key"`
+	}
+	err = db.Select(&rows, "explain "+query, 0)
+	if err != nil {
+		return fmt.Errorf("failed to explain chunk query: %w", err)
+	}
+
+	for _, r := range rows {
+		if r.Table == nil || *r.Table != p.tableName {
+			continue
+		}
+		if r.Type != nil && *r.Type == "range" && r.Key != nil && *r.Key == "PRIMARY" {
+			return nil
+		}
+
+		accessType, key := "NULL", "NULL"
+		if r.Type != nil {
+			accessType = *r.Type
+		}
+		if r.Key != nil {
+			key = *r.Key
+		}
+		return fmt.Errorf("mysql would read chunks with a %s scan of %s instead of a range of PRIMARY, so every chunk would be slower than the last, "+
+			"run with -skip-explain to copy anyway:\n%s", accessType, key, query)
+	}
+
+	return fmt.Errorf("explain of chunk query didn't mention %s:\n%s", p.tableName, query)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyDir is where every alter query we're given gets saved,
+// so that it can be recalled with the -last flag
+var historyDir = filepath.Join(confDir, "smgla", "history")
+
+// saveHistory writes the alter query to a new file in our history dir,
+// named by the time it was submitted so the files sort chronologically
+func saveHistory(alterQuery string, tableName string) error {
+	err := os.MkdirAll(historyDir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	name := time.Now().Format("20060102T150405.000000000") + "-" + tableName + ".sql"
+	return os.WriteFile(filepath.Join(historyDir, name), []byte(alterQuery+"\n"), 0o600)
+}
+
+// lastHistory returns the most recently submitted alter query
+func lastHistory() (string, error) {
+	entries, err := os.ReadDir(historyDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read alter history: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".sql") {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no alter queries in history %q", historyDir)
+	}
+	sort.Strings(names)
+
+	b, err := os.ReadFile(filepath.Join(historyDir, names[len(names)-1]))
+	if err != nil {
+		return "", fmt.Errorf("failed to read alter history: %w", err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// secondaryIndexRegexp matches the definitions of the plain secondary indexes in a creation
+// statement. Unique keys aren't deferred, because our insert ignores count on them to
+// skip the same rows they would've skipped, and the primary key never is. Neither are
+// fulltext and spatial keys, since adding one of those locks the table against writes,
+// and with our triggers on the original table, that'd stall every write to it too
+var secondaryIndexRegexp = regexp.MustCompile("(?m)^  (KEY `((?:[^`]|``)+)` .*?),?$")
+
+// deferrableIndexes gets the definitions and names of the indexes
+// of a creation statement that can wait until the copy is done
+func deferrableIndexes(createMySQL string) (defs []string, names []string) {
+	for _, m := range secondaryIndexRegexp.FindAllStringSubmatch(createMySQL, -1) {
+		defs = append(defs, m[1])
+		names = append(names, m[2])
+	}
+	return defs, names
+}
+
+// dropIndexesSQL drops the given indexes from a table with a single alter
+func dropIndexesSQL(tableName string, names []string) string {
+	drops := make([]string, len(names))
+	for i, name := range names {
+		drops[i] = "drop index`" + name + "`"
+	}
+	return "alter table`" + tableName + "`" + strings.Join(drops, ",")
+}
+
+// addIndexesSQL adds the given index definitions to a table with a single alter, which the
+// server has to refuse rather than run if it can't without blocking writes to the table
+func addIndexesSQL(tableName string, defs []string) string {
+	return "alter table`" + tableName + "`add " + strings.Join(defs, ",add ") + ",algorithm=inplace,lock=none"
+}
+
+// deferIndexes drops the plain secondary indexes from our temp table, so that the copy
+// doesn't have to keep them up to date for every row, and returns their definitions
+// so they can all be added back at once when the copy is done
+func deferIndexes(db *mysql.Database, p *plan) ([]string, error) {
+	var table struct {
+		CreateMySQL string `mysql:"Create Table"`
+	}
+	err := db.Select(&table, "show create table`"+p.tempTableName+"`", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defs, names := deferrableIndexes(table.CreateMySQL)
+	if len(defs) == 0 {
+		return nil, nil
+	}
+
+	log.Printf("deferring %d secondary indexes until the copy is done", len(defs))
+	err = db.Exec(dropIndexesSQL(p.tempTableName, names))
+	if err != nil {
+		return nil, err
+	}
+
+	return defs, nil
+}
+
+// addIndexes adds the deferred indexes back to our temp table with a single alter, showing
+// how it's going from performance_schema's stage events if they're being collected.
+// Index builds can take a while, so being aborted kills the alter instead of waiting on it
+func addIndexes(db *mysql.Database, p *plan, defs []string, g *guard) error {
+	ctx := context.Background()
+	conn, err := db.Writes.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var id int64
+	err = conn.QueryRowContext(ctx, "select connection_id()").Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		watchIndexBuild(db, id, done, g)
+	}()
+
+	log.Printf("adding %d deferred secondary indexes", len(defs))
+	_, err = conn.ExecContext(ctx, addIndexesSQL(p.tempTableName, defs))
+	close(done)
+	<-watched
+	if err != nil {
+		if g.isAborted() {
+			return g.abortErr()
+		}
+		return fmt.Errorf("failed to add deferred indexes: %w", err)
+	}
+
+	return nil
+}
+
+// watchIndexBuild shows the stage and progress of the alter running on the given connection
+// until done is closed, and kills the alter if we're aborted first
+func watchIndexBuild(db *mysql.Database, id int64, done <-chan struct{}, g *guard) {
+	var stage atomic.Value
+	stage.Store("")
+	progress := mpb.New()
+	bar := progress.New(0,
+		mpb.BarStyle().Lbound("|").Filler("▇").Tip("▇").Padding(" ").Rbound("|"),
+		mpb.PrependDecorators(
+			decor.Name(color.HiBlueString("indexes")),
+			decor.OnComplete(decor.Percentage(decor.WC{W: 5}), color.HiMagentaString(" done!")),
+		),
+		mpb.AppendDecorators(
+			decor.Any(func(decor.Statistics) string {
+				return stage.Load().(string)
+			}),
+		),
+	)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	available := true
+	for {
+		select {
+		case <-done:
+			bar.SetTotal(-1, true)
+			progress.Wait()
+			return
+		case <-g.aborted:
+			if err := db.Exec("kill query @@id", mysql.Params{"id": id}); err != nil {
+				log.Println(color.YellowString("failed to kill index build: %v", err))
+			}
+			bar.Abort(false)
+			progress.Wait()
+			<-done
+			return
+		case <-ticker.C:
+		}
+
+		if !available {
+			continue
+		}
+
+		// the stages of an innodb alter are only here with the stage/innodb/alter%
+		// instruments and the events_stages_current consumer turned on
+		var events []struct {
+			EventName     string `mysql:"EVENT_NAME"`
+			WorkCompleted *int64 `mysql:"WORK_COMPLETED"`
+			WorkEstimated *int64 `mysql:"WORK_ESTIMATED"`
+		}
+		err := db.Select(&events, "select s.`EVENT_NAME`,s.`WORK_COMPLETED`,s.`WORK_ESTIMATED`"+
+			"from`performance_schema`.`events_stages_current`s "+
+			"join`performance_schema`.`threads`t using(`THREAD_ID`)"+
+			"where t.`PROCESSLIST_ID`=@@id", 0, mysql.Params{
+			"id": id,
+		})
+		if err != nil {
+			log.Println(color.YellowString("index build progress isn't available: %v", err))
+			available = false
+			continue
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		e := events[0]
+		stage.Store(" " + strings.TrimPrefix(e.EventName, "stage/innodb/"))
+		if e.WorkCompleted != nil && e.WorkEstimated != nil && *e.WorkEstimated > 0 {
+			bar.SetTotal(*e.WorkEstimated, false)
+			bar.SetCurrent(*e.WorkCompleted)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeferrableIndexes(t *testing.T) {
+	create := "CREATE TABLE `orders` (\n" +
+		"  `OrderID` int NOT NULL,\n" +
+		"  `CustomerID` int NOT NULL,\n" +
+		"  `Number` varchar(32) NOT NULL,\n" +
+		"  `Notes` text,\n" +
+		"  `Location` point NOT NULL /*!80003 SRID 4326 */,\n" +
+		"  PRIMARY KEY (`OrderID`),\n" +
+		"  UNIQUE KEY `Number` (`Number`),\n" +
+		"  KEY `CustomerID` (`CustomerID`),\n" +
+		"  KEY `Customer``Number` (`CustomerID`,`Number`),\n" +
+		"  FULLTEXT KEY `Notes` (`Notes`),\n" +
+		"  SPATIAL KEY `Location` (`Location`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+	defs, names := deferrableIndexes(create)
+
+	wantDefs := []string{
+		"KEY `CustomerID` (`CustomerID`)",
+		"KEY `Customer``Number` (`CustomerID`,`Number`)",
+	}
+	if !reflect.DeepEqual(defs, wantDefs) {
+		t.Errorf("defs = %q, want %q", defs, wantDefs)
+	}
+	wantNames := []string{"CustomerID", "Customer``Number"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("names = %q, want %q", names, wantNames)
+	}
+}
+
+func TestAddIndexesSQL(t *testing.T) {
+	want := "alter table`orders_smgla_`add KEY `CustomerID` (`CustomerID`),add KEY `Total` (`Total`),algorithm=inplace,lock=none"
+	got := addIndexesSQL("orders_smgla_", []string{"KEY `CustomerID` (`CustomerID`)", "KEY `Total` (`Total`)"})
+	if got != want {
+		t.Errorf("addIndexesSQL() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+)
+
+// journalDir is where we write down each cutover step before running it,
+// so that a cutover that dies halfway through can be finished with the
+// recover command, instead of by hand in the middle of an outage
+var journalDir = filepath.Join(confDir, "smgla", "journal")
+
+// journalTableName is our table in the schema that holds a copy of each journal,
+// for when the machine that ran the cutover is the thing that died. It doesn't
+// end with our suffix, so the cleanup command leaves it alone
+func journalTableName() string {
+	return *tempTableSuffix + "journal"
+}
+
+// journal is everything the recover command needs to finish
+// or undo a cutover, including the constraints and triggers
+// we captured from the original table before dropping it
+type journal struct {
+	Table     string        `json:"table"`
+	TempTable string        `json:"tempTable"`
+	OldTable  string        `json:"oldTable,omitempty"`
+	Suffix    string        `json:"suffix"`
+	Steps     []cutoverStep `json:"steps"`
+
+	// Step is the index of the step that was about to run
+	Step int `json:"step"`
+
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	file string
+}
+
+func journalFile(dsn string, tableName string) string {
+	return filepath.Join(journalDir, filepath.Base(stateFile(dsn, tableName)))
+}
+
+func newJournal(file string, p *plan, steps []cutoverStep) *journal {
+	return &journal{
+		Table:     p.tableName,
+		TempTable: p.tempTableName,
+		OldTable:  p.oldTableName,
+		Suffix:    *tempTableSuffix,
+		Steps:     steps,
+		Started:   time.Now(),
+		file:      file,
+	}
+}
+
+// hasStep reports whether the cutover has a step of the given kind
+func (j *journal) hasStep(kind string) bool {
+	for _, s := range j.Steps {
+		if s.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// write saves the journal both to its file and to the database, and both have to
+// work, since the step about to run is the one that'd leave us needing them
+func (j *journal) write(db *mysql.Database, step int) error {
+	j.Step = step
+	j.Updated = time.Now()
+
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(j.file), 0o700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(j.file+".tmp", b, 0o600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(j.file+".tmp", j.file)
+	if err != nil {
+		return err
+	}
+
+	err = db.Exec("create table if not exists`" + journalTableName() + "`(" +
+		"`Table`varchar(64)not null primary key," +
+		"`Journal`longtext not null," +
+		"`Updated`datetime not null)")
+	if err != nil {
+		return fmt.Errorf("failed to create journal table: %w", err)
+	}
+
+	return db.Exec("replace into`"+journalTableName()+"`(`Table`,`Journal`,`Updated`)"+
+		"values(@@table,@@journal,now())", mysql.Params{
+		"table":   j.Table,
+		"journal": string(b),
+	})
+}
+
+// remove deletes the journal once the cutover is done, or has been undone
+func (j *journal) remove(db *mysql.Database) error {
+	err := os.Remove(j.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	ok, err := db.Exists("select 0 from`information_schema`.`TABLES`"+
+		"where`TABLE_SCHEMA`=database()and`TABLE_NAME`=@@table", 0, mysql.Params{
+		"table": journalTableName(),
+	})
+	if err != nil || !ok {
+		return err
+	}
+
+	return db.Exec("delete from`"+journalTableName()+"`where`Table`=@@table", mysql.Params{
+		"table": j.Table,
+	})
+}
+
+// loadJournal reads the journal for a table from its file, or if that's
+// missing, from the database, and is nil if neither have one
+func loadJournal(db *mysql.Database, file string, tableName string) (*journal, error) {
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		ok, err := db.Exists("select 0 from`information_schema`.`TABLES`"+
+			"where`TABLE_SCHEMA`=database()and`TABLE_NAME`=@@table", 0, mysql.Params{
+			"table": journalTableName(),
+		})
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		var rows []struct {
+			Journal string
+		}
+		err = db.Select(&rows, "select`Journal`from`"+journalTableName()+"`where`Table`=@@table", 0, mysql.Params{
+			"table": tableName,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		b = []byte(rows[0].Journal)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	j := &journal{file: file}
+	err = json.Unmarshal(b, j)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse journal: %w", err)
+	}
+	return j, nil
+}
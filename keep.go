@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+)
+
+// keptDir is where we remember the tables kept with -keep-old,
+// so that the rollback command knows how to put them back
+var keptDir = filepath.Join(confDir, "smgla", "kept")
+
+// keptTable is a table that was swapped out and kept instead of dropped.
+// Its constraints had to come off of it to free up their names, so
+// we hang on to them here to put them back if it's ever swapped in again
+type keptTable struct {
+	Table    string `json:"table"`
+	OldTable string `json:"oldTable"`
+
+	// Constraints is the block of constraints that
+	// were stripped from the kept table's creation statement
+	Constraints string `json:"constraints,omitempty"`
+
+	Kept time.Time `json:"kept"`
+
+	// ReverseSyncUntil is when the reverse sync into the
+	// kept table ends, and is zero if there wasn't one
+	ReverseSyncUntil time.Time `json:"reverseSyncUntil"`
+
+	file string
+}
+
+func keptFile(dsn string, tableName string) string {
+	return filepath.Join(keptDir, filepath.Base(stateFile(dsn, tableName)))
+}
+
+func (k *keptTable) save() error {
+	b, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(k.file), 0o700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(k.file+".tmp", b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(k.file+".tmp", k.file)
+}
+
+func (k *keptTable) remove() error {
+	err := os.Remove(k.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadKept reads what we remember about a kept table, and is nil if we don't remember anything
+func loadKept(file string) (*keptTable, error) {
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keptTable{file: file}
+	err = json.Unmarshal(b, k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	return k, nil
+}
+
+// rollbackToOld swaps the table kept by -keep-old back in for the altered table, the
+// same way an atomic cutover does, and keeps the altered table in its place, so running
+// it again swaps them right back. Unless a reverse sync was keeping the kept table up to
+// date, anything written to the altered table since the cutover is only in the altered table
+func rollbackToOld(db *mysql.Database, dbDSN string, tableName string) error {
+	if len(tableName) == 0 {
+		return fmt.Errorf("rollback needs the table to roll back, ex: smg-live-alter rollback localhost orders")
+	}
+
+	// a plan with no alter gets us our table names,
+	// and the constraints currently on the table
+	p, err := newPlan(db, tableName, "")
+	if err != nil {
+		return err
+	}
+	err = p.checkSwap()
+	if err != nil {
+		return err
+	}
+
+	exists, err := tableExists(db, p.oldTableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("there's no %q to roll back to, was the alter run with -keep-old?", p.oldTableName)
+	}
+
+	k, err := loadKept(keptFile(dbDSN, tableName))
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		// the constraints on the table now are the original constraints,
+		// plus any the alter added, which is the best guess we've got
+		log.Println(color.YellowString("no record of %q's constraints, giving it the constraints %q has now", p.oldTableName, tableName))
+		k = &keptTable{
+			Table:       tableName,
+			OldTable:    p.oldTableName,
+			Constraints: p.constraints,
+			file:        keptFile(dbDSN, tableName),
+		}
+	}
+
+	log.Println("getting triggers")
+	triggers, err := getTriggers(db, tableName)
+	if err != nil {
+		return err
+	}
+
+	// if a reverse sync is still going, its triggers have nothing left to do once
+	// the kept table is swapped back in. The plan has no columns, but the names are all we need
+	var reverseTriggers []string
+	for _, t := range p.reverseTriggers() {
+		reverseTriggers = append(reverseTriggers, t.name)
+	}
+
+	steps, err := swap{
+		table:               tableName,
+		incoming:            p.oldTableName,
+		outgoing:            p.oldTableName,
+		via:                 p.tempTableName,
+		outgoingConstraints: p.constraints,
+		incomingConstraints: k.Constraints,
+		helperTriggers:      reverseTriggers,
+		triggers:            triggers,
+		keep:                true,
+	}.steps(db)
+	if err != nil {
+		return err
+	}
+
+	if k.ReverseSyncUntil.After(time.Now()) {
+		log.Printf("writes to %q have been mirrored into %q since the cutover", tableName, p.oldTableName)
+	} else {
+		log.Println(color.YellowString("anything written to %q since the cutover (or since its reverse sync ended) won't be in %q", tableName, p.oldTableName))
+	}
+	if !yesNo(fmt.Sprintf("swap %q back in for %q?", p.oldTableName, tableName)) {
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := db.Writes.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		conn.ExecContext(ctx, "unlock tables")
+		conn.ExecContext(ctx, "set foreign_key_checks=1")
+		conn.Close()
+	}()
+
+	log.Println("disabling foreign key checks for our connection")
+	_, err = conn.ExecContext(ctx, "set foreign_key_checks=0")
+	if err != nil {
+		return err
+	}
+
+	for i, s := range steps {
+		log.Println(s.Description)
+		_, err = conn.ExecContext(ctx, s.Query)
+		if err != nil {
+			if i != 0 {
+				log.Println(color.RedString("the rollback stopped halfway through, run these statements with the mysql client to finish:"))
+				fmt.Fprintln(os.Stderr, color.CyanString(recoverySQL(steps[i:])))
+			}
+			return err
+		}
+	}
+
+	// the table we just swapped out is now the kept one
+	k.Constraints = p.constraints
+	k.Kept = time.Now()
+	k.ReverseSyncUntil = time.Time{}
+	if err := k.save(); err != nil {
+		log.Println(color.YellowString("failed to save the kept table's constraints: %v", err))
+	}
+
+	log.Printf("rolled back %s, the altered table is kept as %s", tableName, p.oldTableName)
+
+	return nil
+}
+
+// purgeOld drops the table kept by -keep-old, once it's clear it won't be needed
+func purgeOld(db *mysql.Database, dbDSN string, tableName string) error {
+	if len(tableName) == 0 {
+		return fmt.Errorf("purge-old needs the table whose kept copy to drop, ex: smg-live-alter purge-old localhost orders")
+	}
+
+	oldTableName := tableName + *oldTableSuffix
+
+	var tables []leftoverTable
+	err := db.Select(&tables, "select`TABLE_NAME`,coalesce(`TABLE_ROWS`,0)`TABLE_ROWS`,"+
+		"coalesce(`DATA_LENGTH`,0)`DATA_LENGTH`,coalesce(`INDEX_LENGTH`,0)`INDEX_LENGTH`"+
+		"from`information_schema`.`TABLES`"+
+		"where`TABLE_SCHEMA`=database()"+
+		"and`TABLE_NAME`=@@table", 0, mysql.Params{
+		"table": oldTableName,
+	})
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("there's no %q to purge", oldTableName)
+	}
+
+	// the reverse triggers write into the kept table, so dropping it
+	// out from under them would break every write to the altered table
+	syncing, err := reverseSyncing(db, tableName)
+	if err != nil {
+		return err
+	}
+	if syncing {
+		return fmt.Errorf("writes to %q are still being mirrored into %q, use the finalize command instead", tableName, oldTableName)
+	}
+
+	t := tables[0]
+	fmt.Printf("  %s ~%d rows, %s\n", color.HiCyanString(t.TableName), t.TableRows, formatBytes(t.DataLength+t.IndexLength))
+	if !yesNo(fmt.Sprintf("drop %q?", oldTableName)) {
+		return nil
+	}
+
+	log.Println("dropping table", oldTableName)
+	err = db.Exec("drop table if exists`" + oldTableName + "`")
+	if err != nil {
+		return err
+	}
+
+	k := &keptTable{file: keptFile(dbDSN, tableName)}
+	if err := k.remove(); err != nil {
+		log.Println(color.YellowString("failed to remove kept table record: %v", err))
+	}
+
+	return nil
+}
+
+// reverseSyncing is whether any of the reverse triggers are still on the table
+func reverseSyncing(db *mysql.Database, tableName string) (bool, error) {
+	p := &plan{tableName: tableName, oldTableName: tableName + *oldTableSuffix}
+	for _, t := range p.reverseTriggers() {
+		exists, err := triggerExists(db, tableName, t.name)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// dropReverseTriggers ends a reverse sync, leaving the kept table how it was at that moment
+func dropReverseTriggers(db *mysql.Database, p *plan) error {
+	for _, t := range p.reverseTriggers() {
+		log.Println("dropping reverse trigger", t.name)
+		err := db.Exec("drop trigger if exists`" + t.name + "`")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitReverseSync waits out the reverse sync, and then ends it. The kept table stays around
+// either way, for the rollback, purge-old, or finalize commands. Being interrupted while
+// waiting leaves the reverse sync going, since a signal here usually means someone
+// just wants their terminal back, and stopping it early is what finalize is for
+func waitReverseSync(db *mysql.Database, p *plan, g *guard) error {
+	until := time.Now().Add(*reverseSync)
+	log.Printf("mirroring writes to %s back into %s until %s", p.tableName, p.oldTableName, until.Format("2006-01-02 15:04:05"))
+
+	select {
+	case <-time.After(time.Until(until)):
+	case <-g.aborted:
+		log.Println(color.YellowString("stopped waiting, writes are still being mirrored into %s", p.oldTableName))
+		log.Printf("run \"smg-live-alter finalize <connection> %s\" to stop it", p.tableName)
+		return nil
+	}
+
+	log.Println("reverse sync window is over")
+	err := dropReverseTriggers(db, p)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s is kept as it was at the end of the window, use the rollback command to swap it back in or purge-old to drop it", p.oldTableName)
+	return nil
+}
+
+// finalize ends a reverse sync early (or after the tool that started it went away),
+// dropping the reverse triggers and then the kept table
+func finalize(db *mysql.Database, dbDSN string, tableName string) error {
+	if len(tableName) == 0 {
+		return fmt.Errorf("finalize needs the table being reverse synced, ex: smg-live-alter finalize localhost orders")
+	}
+
+	p := &plan{tableName: tableName, oldTableName: tableName + *oldTableSuffix}
+
+	syncing, err := reverseSyncing(db, tableName)
+	if err != nil {
+		return err
+	}
+	if !syncing {
+		log.Printf("writes to %q aren't being mirrored anywhere", tableName)
+	} else if !yesNo(fmt.Sprintf("stop mirroring writes to %q into %q?", tableName, p.oldTableName)) {
+		return nil
+	}
+
+	err = dropReverseTriggers(db, p)
+	if err != nil {
+		return err
+	}
+
+	return purgeOld(db, dbDSN, tableName)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/vbauerster/mpb/v8"
+)
+
+// binaryTypes are the data types of binary strings
+var binaryTypes = []string{"binary", "varbinary", "blob", "tinyblob", "mediumblob", "longblob"}
+
+// loadDataHex reports whether values of the given data type go through load data as hex,
+// since their bytes aren't in any character set, and load data would try to convert them
+func loadDataHex(dataType string) bool {
+	return slices.Contains(binaryTypes, dataType) || slices.Contains(spatialTypes, dataType) ||
+		dataType == "bit" || dataType == "vector"
+}
+
+// loadDataReaders is how many readers we've registered with the driver, so that
+// every chunk, from every worker, gets a reader name of its own
+var loadDataReaders atomic.Int64
+
+// loadDataSelectColumns is the column list for reading rows out of the original table
+// for load data, which is the same as selectColumns except that binary values, like binary
+// strings, bits, and spatial values, are read as hex, and floats are read as doubles,
+// followed by the row's primary key values for our checkpoint. Spatial values are read
+// in mysql's own format, which has their SRID along with their well-known binary
+func (p *plan) loadDataSelectColumns() string {
+	cols := make([]string, 0, len(p.oldColumns)+1)
+	for i, c := range p.oldColumns {
+		switch {
+		case loadDataHex(c.DataType):
+			cols = append(cols, fmt.Sprintf("hex(`%s`)`%s`", c.ColumnName, p.newColumns[i].ColumnName))
+		case c.DataType == "float":
+			// the same as the raw transport, floats are written with only about 6 digits,
+			// and doubles with as many as it takes to get them back
+			cols = append(cols, fmt.Sprintf("`%s`+0e0`%s`", c.ColumnName, p.newColumns[i].ColumnName))
+		default:
+			cols = append(cols, fmt.Sprintf("`%s` `%s`", c.ColumnName, p.newColumns[i].ColumnName))
+		}
+	}
+	cols = append(cols, p.primaryKeyLiteral()+"`_smgla_bound`")
+	return strings.Join(cols, ",")
+}
+
+// loadDataQuery loads the rows written to the reader registered as name into our temp table,
+// unhexing the binary columns on the way in. Rows our triggers already copied are ignored,
+// just like with insert ignore
+func (p *plan) loadDataQuery(name string) string {
+	cols := make([]string, len(p.newColumns))
+	var sets []string
+	for i, c := range p.newColumns {
+		if loadDataHex(p.oldColumns[i].DataType) {
+			cols[i] = "@v" + strconv.Itoa(i)
+			sets = append(sets, fmt.Sprintf("`%s`=unhex(@v%d)", c.ColumnName, i))
+		} else {
+			cols[i] = "`" + c.ColumnName + "`"
+		}
+	}
+
+	query := "load data local infile'Reader::" + name + "'ignore into table`" + p.tempTableName + "`" +
+		"character set utf8mb4 " +
+		"fields terminated by'\\t'escaped by'\\\\'" +
+		"lines terminated by'\\n'" +
+		"(" + strings.Join(cols, ",") + ")"
+	if len(sets) != 0 {
+		query += "set " + strings.Join(sets, ",")
+	}
+	return query
+}
+
+// writeTSVField writes a value the way load data reads it with its default escaping,
+// where a nil value is a NULL
+func writeTSVField(w *bufio.Writer, v sql.RawBytes) {
+	if v == nil {
+		w.WriteString(`\N`)
+		return
+	}
+
+	for _, b := range v {
+		switch b {
+		case '\\':
+			w.WriteString(`\\`)
+		case '\t':
+			w.WriteString(`\t`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case 0:
+			w.WriteString(`\0`)
+		default:
+			w.WriteByte(b)
+		}
+	}
+}
+
+// selectTSV runs the select for a chunk and writes its rows to w as tab separated values,
+// and returns the primary key values of every one of them
+func selectTSV(db *mysql.Database, query string, w io.Writer) (bounds []string, err error) {
+	rows, err := db.Reads.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]sql.RawBytes, len(cols))
+	dest := make([]any, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	bw := bufio.NewWriter(w)
+	for rows.Next() {
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+
+		// the last column is our bound, and isn't loaded
+		for i, v := range values[:len(values)-1] {
+			if i != 0 {
+				bw.WriteByte('\t')
+			}
+			writeTSVField(bw, v)
+		}
+		bw.WriteByte('\n')
+
+		bounds = append(bounds, string(values[len(values)-1]))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bounds, bw.Flush()
+}
+
+// copyRowsLoadData copies a range of rows from the original table into our temp table,
+// a chunk at a time, by streaming each chunk straight from its select into a load data
+// local infile. Load data isn't limited by max_allowed_packet like a multi-row insert,
+// and every chunk is done once its load data is, so the primary key values of its
+// last row are always a safe checkpoint
+func copyRowsLoadData(db *mysql.Database, p *plan, st *state, r *keyRange, bar *mpb.Bar, g *guard, t *throttler) error {
+	checkpoint := r.Checkpoint
+	copied := r.Copied
+	lastSave := time.Now()
+
+	size := initialServerChunkSize
+
+	for {
+		t.wait(g)
+		if g.isAborted() {
+			return g.abortErr()
+		}
+
+		chunkStart := time.Now()
+
+		query, err := p.chunkSelectQuery(db, p.loadDataSelectColumns(), p.rangeWhere(checkpoint, r.End), size)
+		if err != nil {
+			return err
+		}
+
+		pr, pw := io.Pipe()
+		name := fmt.Sprintf("smgla-%d", loadDataReaders.Add(1))
+		mysqldriver.RegisterReaderHandler(name, func() io.Reader {
+			return pr
+		})
+
+		var bounds []string
+		var selectErr error
+		selectDone := make(chan struct{})
+		go func() {
+			defer close(selectDone)
+			bounds, selectErr = selectTSV(db, query, pw)
+			pw.CloseWithError(selectErr)
+		}()
+
+		err = db.Exec(p.loadDataQuery(name))
+		// if load data never got around to reading, this
+		// is what gets the select to stop writing
+		pr.CloseWithError(err)
+		<-selectDone
+		mysqldriver.DeregisterReaderHandler(name)
+		if err != nil {
+			return fmt.Errorf("failed to load chunk: %w", err)
+		}
+		if selectErr != nil {
+			return fmt.Errorf("failed to execute main select: %w", selectErr)
+		}
+
+		// the lines of the file are the rows of the select, in order
+		err = reportChunkCoercions(db, func(n int) string {
+			if n > len(bounds) {
+				return ""
+			}
+			return bounds[n-1]
+		})
+		if err != nil {
+			return err
+		}
+
+		rows := int64(len(bounds))
+		copied += rows
+		bar.IncrBy(int(rows))
+		bar.DecoratorEwmaUpdate(time.Since(chunkStart))
+
+		if len(bounds) != 0 {
+			checkpoint = bounds[len(bounds)-1]
+		}
+
+		// a chunk with fewer rows than we asked for means the range has run out
+		if rows < int64(size) {
+			return st.finishRange(r, checkpoint, copied)
+		}
+
+		if time.Since(lastSave) >= checkpointInterval {
+			lastSave = time.Now()
+			if err := st.checkpoint(r, checkpoint, copied); err != nil {
+				log.Println(color.YellowString("failed to save checkpoint: %v", err))
+			}
+		}
+
+		size = resizeChunk(size, time.Since(chunkStart), t.targetChunkTime())
+
+		t.limit(rows, chunkStart)
+	}
+}
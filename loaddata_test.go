@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// typesPlan is a plan for a table with a column of each of the types
+// that go through load data as something other than themselves
+func typesPlan() *plan {
+	columns := []column{
+		{ColumnName: "ID", Position: 1, DataType: "int", ColumnType: "int", PrimaryKey: true},
+		{ColumnName: "Bits", Position: 2, DataType: "bit", ColumnType: "bit(10)"},
+		{ColumnName: "Year", Position: 3, DataType: "year", ColumnType: "year"},
+		{ColumnName: "Time", Position: 4, DataType: "time", ColumnType: "time(6)"},
+		{ColumnName: "Vector", Position: 5, DataType: "vector", ColumnType: "vector(3)"},
+		{ColumnName: "Point", Position: 6, DataType: "point", ColumnType: "point"},
+		{ColumnName: "Shape", Position: 7, DataType: "geometry", ColumnType: "geometry"},
+		{ColumnName: "Float", Position: 8, DataType: "float", ColumnType: "float"},
+	}
+
+	return &plan{
+		tableName:         "types",
+		tempTableName:     "types_smgla_",
+		oldColumns:        columns,
+		newColumns:        columns,
+		oldPrimaryColumns: columns[:1],
+		newPrimaryColumns: columns[:1],
+	}
+}
+
+func TestLoadDataSelectColumns(t *testing.T) {
+	want := "`ID` `ID`," +
+		"hex(`Bits`)`Bits`," +
+		"`Year` `Year`," +
+		"`Time` `Time`," +
+		"hex(`Vector`)`Vector`," +
+		"hex(`Point`)`Point`," +
+		"hex(`Shape`)`Shape`," +
+		"`Float`+0e0`Float`," +
+		"concat_ws(',',`ID`)`_smgla_bound`"
+
+	if got := typesPlan().loadDataSelectColumns(); got != want {
+		t.Errorf("loadDataSelectColumns() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLoadDataQuery(t *testing.T) {
+	want := "load data local infile'Reader::chunk'ignore into table`types_smgla_`" +
+		"character set utf8mb4 " +
+		"fields terminated by'\\t'escaped by'\\\\'" +
+		"lines terminated by'\\n'" +
+		"(`ID`,@v1,`Year`,`Time`,@v4,@v5,@v6,`Float`)" +
+		"set `Bits`=unhex(@v1),`Vector`=unhex(@v4),`Point`=unhex(@v5),`Shape`=unhex(@v6)"
+
+	if got := typesPlan().loadDataQuery("chunk"); got != want {
+		t.Errorf("loadDataQuery() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteTSVField(t *testing.T) {
+	tests := []struct {
+		name  string
+		value sql.RawBytes
+		want  string
+	}{
+		{name: "null", value: nil, want: `\N`},
+		{name: "empty", value: sql.RawBytes{}, want: ``},
+		{name: "year", value: sql.RawBytes("1901"), want: `1901`},
+		{name: "negative time", value: sql.RawBytes("-838:59:59.000000"), want: `-838:59:59.000000`},
+		{name: "hex bits", value: sql.RawBytes("02AA"), want: `02AA`},
+		{name: "hex point", value: sql.RawBytes("000000000101000000000000000000F03F0000000000000040"), want: `000000000101000000000000000000F03F0000000000000040`},
+		{name: "escapes", value: sql.RawBytes("a\\b\tc\nd\re\x00f"), want: `a\\b\tc\nd\re\0f`},
+		{name: "raw bytes", value: sql.RawBytes{0x00, 0x09, 0x0a, 0xff}, want: "\\0\\t\\n\xff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := new(strings.Builder)
+			w := bufio.NewWriter(b)
+			writeTSVField(w, tt.value)
+			w.Flush()
+
+			if got := b.String(); got != tt.want {
+				t.Errorf("writeTSVField() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
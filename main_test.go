@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+)
+
+// testDB connects to the database in SMGLA_TEST_DSN, which should be a schema that's
+// safe to make and drop tables in, and skips the test if there isn't one
+func testDB(t *testing.T) *mysql.Database {
+	t.Helper()
+
+	dsn := os.Getenv("SMGLA_TEST_DSN")
+	if len(dsn) == 0 {
+		t.Skip("SMGLA_TEST_DSN isn't set")
+	}
+
+	db, err := mysql.NewFromDSN(dsn, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DisableUnusedColumnWarnings = true
+	return db
+}
+
+// testExec runs queries that have to work for the test to mean anything
+func testExec(t *testing.T, db *mysql.Database, queries ...string) {
+	t.Helper()
+
+	for _, q := range queries {
+		if err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/juliangruber/go-intersect/v2"
+)
+
+// plan is everything we need to know about an alter to actually run it,
+// from the names of the tables, to how the columns of the original table
+// map to the columns of the altered one, to what has to be put back
+// on the table once the swap is done
+type plan struct {
+	tableName     string
+	tempTableName string
+	alterPart     string
+
+	// oldTableName is what the original table is renamed to during an
+	// atomic cutover, and where it's kept afterwards with -keep-old
+	oldTableName string
+
+	// createTempTable is the original table's creation statement,
+	// renamed to our temp table and with its constraints removed
+	createTempTable string
+
+	// constraints is the block of constraints that we stripped
+	// from the creation statement, to be added back later
+	constraints string
+
+	// oldColumns and newColumns are the columns that exist in both
+	// the original and altered table, and are lined up by index, so
+	// oldColumns[i] is always copied into newColumns[i]
+	oldColumns []column
+	newColumns []column
+
+	oldPrimaryColumns []column
+	newPrimaryColumns []column
+
+	// expandKeyset spells out comparisons of a composite primary key,
+	// for servers that don't read row constructor comparisons as a range
+	expandKeyset bool
+
+	// serverVersion is the version of the server the table is on
+	serverVersion string
+}
+
+// newPlan starts our plan from the original table's creation statement,
+// the columns get filled in later by mapColumns once the temp table exists
+func newPlan(db *mysql.Database, tableName string, alterPart string) (*plan, error) {
+	p := &plan{
+		tableName:     tableName,
+		tempTableName: tableName + *tempTableSuffix,
+		oldTableName:  tableName + *oldTableSuffix,
+		alterPart:     alterPart,
+	}
+
+	log.Println("getting table creation statement")
+	// now we get the table creation syntax from our source
+	var table struct {
+		CreateMySQL string `mysql:"Create Table"`
+	}
+	err := db.Select(&table, "show create table`"+tableName+"`", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// since foreign key constraints have globally unique names (for some reason)
+	// we can't just create our temp table with constraints because
+	// the names will likely conflict with the table that already exists
+
+	// so we will strip the constraints here and add them back once we're done
+
+	// we can safely assume the constraints start like this because you can't have
+	// constraints without columns!
+	constraintsStart := strings.Index(table.CreateMySQL, ",\n  CONSTRAINT ")
+	if constraintsStart != -1 {
+		// we have the start of our constraints block, and since mysql
+		// always (hopefully) gives them in a block, we can find the last
+		// constraint and everything in the middle is what we want
+		constraintsEnd := strings.LastIndex(table.CreateMySQL, ",\n  CONSTRAINT ")
+
+		// but we need the end of the line, so we'll get the byte index of the newline
+		// after our last index as our end marker
+		constraintsEnd = constraintsEnd + strings.IndexByte(table.CreateMySQL[constraintsEnd+2:], '\n') + 2
+
+		// then we can keep track of our constraints so we can add them back
+		// to our table once we've dropped the original table
+		p.constraints = table.CreateMySQL[constraintsStart:constraintsEnd]
+
+		// and store our create query without our constraints
+		table.CreateMySQL = table.CreateMySQL[:constraintsStart] + table.CreateMySQL[constraintsEnd:]
+	}
+
+	p.createTempTable = "CREATE TABLE `" + p.tempTableName + "`" + strings.TrimPrefix(table.CreateMySQL, "CREATE TABLE `"+tableName+"`")
+
+	var version struct {
+		Version string
+	}
+	err = db.Select(&version, "select version()`Version`", 0)
+	if err != nil {
+		return nil, err
+	}
+	p.serverVersion = version.Version
+	p.expandKeyset = !rowConstructorRanges(version.Version)
+
+	return p, nil
+}
+
+// rowConstructorRanges reports whether a server of the given version can be trusted
+// to read a comparison like (a,b)>(1,2) as a range of the primary key. Before mysql 8,
+// it's not uncommon for it to be read with a scan of everything from the start instead
+func rowConstructorRanges(version string) bool {
+	if strings.Contains(version, "MariaDB") {
+		return false
+	}
+	major, _, _ := strings.Cut(version, ".")
+	n, err := strconv.Atoi(major)
+	return err == nil && n >= 8
+}
+
+// alterTempTableSQL applies the user's alter to our temp table
+func (p *plan) alterTempTableSQL() string {
+	return fmt.Sprintf("alter table`%s`%s", p.tempTableName, p.alterPart)
+}
+
+// mapColumns figures out which of the original table's columns are copied
+// into which of the altered table's columns, keeping track of renamed
+// columns and ignoring any columns that don't exist on both sides
+func (p *plan) mapColumns(oldColumns, newColumns []column) error {
+	oldColumnsMap := make(map[string]string)
+	for _, c := range oldColumns {
+		oldColumnsMap[c.ColumnName] = c.ColumnName
+	}
+	changedColumns := parseChangeColumnRegex.FindAllStringSubmatch(p.alterPart, -1)
+	for _, m := range changedColumns {
+		if m[1] != m[2] {
+			oldColumnsMap[m[1]] = m[2]
+		}
+	}
+
+	newColumnsByName := make(map[string]column, len(newColumns))
+	for _, c := range newColumns {
+		// we never want anything to do with new generated columns
+		if len(c.GenerationExpression) != 0 {
+			continue
+		}
+
+		newColumnsByName[c.ColumnName] = c
+	}
+
+	p.oldColumns = make([]column, 0, len(oldColumns))
+	p.newColumns = make([]column, 0, len(oldColumns))
+	p.oldPrimaryColumns = make([]column, 0)
+	p.newPrimaryColumns = make([]column, 0)
+
+	for _, c := range oldColumns {
+		newColumn, ok := newColumnsByName[oldColumnsMap[c.ColumnName]]
+		if !ok {
+			continue
+		}
+
+		p.oldColumns = append(p.oldColumns, c)
+		p.newColumns = append(p.newColumns, newColumn)
+
+		if c.PrimaryKey {
+			p.oldPrimaryColumns = append(p.oldPrimaryColumns, c)
+		}
+	}
+
+	// the primary key is read, compared, and ordered by in the order of its index,
+	// which is the only order mysql can read as a range of it
+	slices.SortStableFunc(p.oldPrimaryColumns, func(a, b column) int {
+		return a.PrimaryKeySeq - b.PrimaryKeySeq
+	})
+
+	// and the altered table's primary key columns are lined up with the original table's,
+	// since our triggers match rows by comparing the two. Any that aren't copied from
+	// the original table's primary key go after them, in the order of their own index
+	keyOrder := make(map[string]int, len(p.newColumns))
+	for i, c := range p.newColumns {
+		if !c.PrimaryKey {
+			continue
+		}
+		p.newPrimaryColumns = append(p.newPrimaryColumns, c)
+		if old := p.oldColumns[i]; old.PrimaryKey {
+			keyOrder[c.ColumnName] = old.PrimaryKeySeq
+		} else {
+			keyOrder[c.ColumnName] = len(oldColumns) + c.PrimaryKeySeq
+		}
+	}
+	slices.SortStableFunc(p.newPrimaryColumns, func(a, b column) int {
+		return keyOrder[a.ColumnName] - keyOrder[b.ColumnName]
+	})
+
+	if len(p.newPrimaryColumns) != len(p.oldPrimaryColumns) {
+		oldPrimaryColumnNames := columnNames(p.oldPrimaryColumns)
+		newPrimaryColumnNames := columnNames(p.newPrimaryColumns)
+		isect := intersect.HashGeneric(oldPrimaryColumnNames, newPrimaryColumnNames)
+		if len(isect) < len(p.oldPrimaryColumns) && len(isect) < len(p.newPrimaryColumns) {
+			return errors.New("primary key column names and number of primary key columns changed at the same time")
+		}
+
+		if len(isect) == len(p.oldPrimaryColumns) {
+			p.newPrimaryColumns = p.oldPrimaryColumns
+		} else {
+			p.oldPrimaryColumns = p.newPrimaryColumns
+		}
+	}
+
+	if len(p.oldPrimaryColumns) == 0 {
+		return fmt.Errorf("table %q has no primary key", p.tableName)
+	}
+
+	return nil
+}
+
+// sortPrimaryKeyFields sorts the indexes of the primary key's columns in newColumns, which
+// are in the order of the table's columns, into the order of the primary key, so the
+// values of a row's fields make a checkpoint we can compare to the primary key
+func (p *plan) sortPrimaryKeyFields(fields []int) {
+	order := make(map[string]int, len(p.newPrimaryColumns))
+	for i, c := range p.newPrimaryColumns {
+		order[c.ColumnName] = i
+	}
+	slices.SortStableFunc(fields, func(a, b int) int {
+		return order[p.newColumns[a].ColumnName] - order[p.newColumns[b].ColumnName]
+	})
+}
+
+// selectColumns is the column list for selecting rows out of the
+// original table, aliased to the names of the altered table's columns.
+// Spatial columns are selected as the ST_GeomFromWKB call that makes them
+// again, since their well-known binary alone would lose their SRID
+func (p *plan) selectColumns() string {
+	selectColumns := new(strings.Builder)
+	for i, c := range p.oldColumns {
+		if i != 0 {
+			selectColumns.WriteByte(',')
+		}
+		if slices.Contains(spatialTypes, p.newColumns[i].DataType) {
+			selectColumns.WriteString(fmt.Sprintf("ifnull(concat('ST_GeomFromWKB(X''',hex(ST_AsWKB(`%s`)),''',',ST_SRID(`%s`),')'),'null')`%s`",
+				c.ColumnName, c.ColumnName, p.newColumns[i].ColumnName))
+			continue
+		}
+		selectColumns.WriteString(fmt.Sprintf("`%s` `%s`", c.ColumnName, p.newColumns[i].ColumnName))
+	}
+	return selectColumns.String()
+}
+
+// triggers are the triggers that keep our temp table in sync with
+// the original table while we're copying rows into it
+func (p *plan) triggers() []syncTrigger {
+	return syncTriggers(*tempTableSuffix, p.tableName, p.tempTableName,
+		p.oldColumns, p.newColumns, p.oldPrimaryColumns, p.newPrimaryColumns)
+}
+
+// reverseTriggers are the triggers that mirror writes on the altered table back into the
+// kept original table during a reverse sync. It's the same mapping as our sync triggers,
+// just the other way around, and they're named after the kept table so that
+// cleanup doesn't mistake them for something left behind
+func (p *plan) reverseTriggers() []syncTrigger {
+	return syncTriggers(*oldTableSuffix, p.tableName, p.oldTableName,
+		p.newColumns, p.oldColumns, p.newPrimaryColumns, p.oldPrimaryColumns)
+}
+
+// rangeWhere is the where clause for the rows after the primary key values of after,
+// up to and including the ones of upTo, where either can be empty for no bound
+func (p *plan) rangeWhere(after, upTo string) string {
+	var conds []string
+	if len(after) != 0 {
+		conds = append(conds, p.keysetCond(">", after))
+	}
+	if len(upTo) != 0 {
+		conds = append(conds, p.keysetCond("<=", upTo))
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return "where" + strings.Join(conds, "and")
+}
+
+// keysetCond compares the primary key to the given primary key values with op, which
+// is either > or <=. With expandKeyset, (a,b,c)>(1,2,3) is spelled out as
+// a>=1 and(a>1 or a=1 and(b>2 or b=2 and c>3)), where the first comparison
+// is the one that lets mysql see it as a range of the primary key
+func (p *plan) keysetCond(op string, values string) string {
+	cols := p.oldPrimaryColumns
+	literals := splitLiterals(values)
+	if !p.expandKeyset || len(cols) == 1 || len(literals) != len(cols) {
+		return "(" + quoteColumns(cols) + ")" + op + "(" + values + ")"
+	}
+
+	strict := op[:1]
+	n := len(cols)
+	cond := "`" + cols[n-1].ColumnName + "`" + op + literals[n-1]
+	for i := n - 2; i >= 0; i-- {
+		col := "`" + cols[i].ColumnName + "`"
+		cond = col + strict + literals[i] + " or " + col + "=" + literals[i] + " and(" + cond + ")"
+	}
+	return "(`" + cols[0].ColumnName + "`" + strict + "=" + literals[0] + " and(" + cond + "))"
+}
+
+// splitLiterals splits a list of mysql literals, like our checkpoints, into
+// each of its literals, without being fooled by commas in strings
+func splitLiterals(s string) []string {
+	var literals []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			// a doubled quote closes and opens the string again, which works out the same
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == 0 && c == ',':
+			literals = append(literals, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(literals, s[start:])
+}
+
+// copySelectQuery is the select used to read a chunk of rows out of the original table,
+// where the where clause is empty for the very first chunk
+func (p *plan) copySelectQuery(db *mysql.Database, where string, limit int) (string, error) {
+	return p.chunkSelectQuery(db, p.selectColumns(), where, limit)
+}
+
+// chunkSelectQuery selects cols from a chunk of rows of the original table
+func (p *plan) chunkSelectQuery(db *mysql.Database, cols string, where string, limit int) (string, error) {
+	query, _, err := db.InterpolateParams("select /*+ MAX_EXECUTION_TIME(2147483647) */@@cols "+
+		"from @@table "+
+		"@@where "+
+		"order by @@pks "+
+		"limit @@limit ", mysql.Params{
+		"cols":  mysql.Raw(cols),
+		"table": mysql.Raw(fmt.Sprintf("`%s`", p.tableName)),
+		"where": mysql.Raw(where),
+		"pks":   mysql.Raw(quoteColumns(p.oldPrimaryColumns)),
+		"limit": limit,
+	})
+	return query, err
+}
+
+// primaryKeyLiteral is an expression for the primary key values of a row as mysql literals,
+// so they can go right back into a where clause (and our checkpoints) without making
+// a round trip through Go types. Integers are left as they are, because comparing
+// an integer column to a string compares them as doubles, which big ids don't survive
+func (p *plan) primaryKeyLiteral() string {
+	literals := make([]string, len(p.oldPrimaryColumns))
+	for i, c := range p.oldPrimaryColumns {
+		if slices.Contains(integerTypes, c.DataType) {
+			literals[i] = "`" + c.ColumnName + "`"
+		} else {
+			literals[i] = "quote(`" + c.ColumnName + "`)"
+		}
+	}
+	return "concat_ws(','," + strings.Join(literals, ",") + ")"
+}
+
+// chunkBoundQuery gets the primary key values of the last row of the next chunk,
+// and has no rows for the last chunk
+func (p *plan) chunkBoundQuery(where string, size int) string {
+	return "select " + p.primaryKeyLiteral() + "`Bound`" +
+		"from`" + p.tableName + "`" + where +
+		"order by " + quoteColumns(p.oldPrimaryColumns) + " " +
+		"limit 1 offset " + strconv.Itoa(size-1)
+}
+
+// lastRowQuery gets the primary key values of the last row of the original table
+func (p *plan) lastRowQuery() string {
+	desc := make([]string, len(p.oldPrimaryColumns))
+	for i, c := range p.oldPrimaryColumns {
+		desc[i] = "`" + c.ColumnName + "`desc"
+	}
+	return "select " + p.primaryKeyLiteral() + "`Bound`" +
+		"from`" + p.tableName + "`" +
+		"order by " + strings.Join(desc, ",") + " " +
+		"limit 1"
+}
+
+// insertSelectQuery copies a chunk of rows straight from the original table
+// into our temp table, without the rows ever leaving the server
+func (p *plan) insertSelectQuery(where string) string {
+	return fmt.Sprintf("insert ignore into`%s`(%s)select %s from`%s`%sorder by %s",
+		p.tempTableName, quoteColumns(p.newColumns), quoteColumns(p.oldColumns), p.tableName, where, quoteColumns(p.oldPrimaryColumns))
+}
+
+// addConstraintsSQL converts a block of constraints stripped from a creation statement
+// to alter table syntax by removing the leading comma and adding the word "add"
+// at the beginning of each line, and is empty if there aren't any constraints
+func addConstraintsSQL(tableName string, constraints string) string {
+	if len(constraints) == 0 {
+		return ""
+	}
+	return "alter table`" + tableName + "`" + strings.ReplaceAll(strings.TrimLeft(constraints, ","), "\n", "\nadd")
+}
+
+// renameSQL renames our temp table to the real table name
+func (p *plan) renameSQL() string {
+	return "alter table`" + p.tempTableName + "`rename`" + p.tableName + "`"
+}
+
+// cutoverStep is a single statement of the cutover, along with what we tell the
+// user while it's running, and enough about what it does for the recover
+// command to tell whether it has already happened or not
+type cutoverStep struct {
+	Description string `json:"description"`
+	Query       string `json:"query"`
+
+	// Kind is what the step does, Table is the table it does it to,
+	// and Names are the names of the constraints or triggers it makes or drops
+	Kind  string   `json:"kind"`
+	Table string   `json:"table"`
+	Names []string `json:"names,omitempty"`
+}
+
+const (
+	stepDrop        = "drop"
+	stepConstraints = "constraints"
+	stepTrigger     = "trigger"
+	stepRename      = "rename"
+
+	// only used by the atomic cutover
+	stepLock            = "lock"
+	stepSwap            = "swap"
+	stepDropConstraints = "dropConstraints"
+	stepDropTrigger     = "dropTrigger"
+	stepUnlock          = "unlock"
+)
+
+var constraintNamesRegexp = regexp.MustCompile("(?m)^\\s*CONSTRAINT `([^`]+)`")
+
+// cutoverSteps are the statements that swap our temp table in for the original table,
+// in the order they have to be run. The first step drops the original table, and
+// once that's happened the only way out is through the rest of the steps
+func (p *plan) cutoverSteps(triggers []*trigger) []cutoverStep {
+	steps := make([]cutoverStep, 0, len(triggers)+3)
+
+	// drop the old table now that our temp table is done
+	steps = append(steps, cutoverStep{
+		Description: "dropping the original table",
+		Query:       "drop table if exists`" + p.tableName + "`",
+		Kind:        stepDrop,
+		Table:       p.tableName,
+	})
+
+	// no we can add back our constraints if we have them
+	if addConstraints := addConstraintsSQL(p.tempTableName, p.constraints); len(addConstraints) != 0 {
+		steps = append(steps, cutoverStep{
+			Description: "adding constraints",
+			Query:       addConstraints,
+			Kind:        stepConstraints,
+			Table:       p.tempTableName,
+			Names:       constraintNames(p.constraints),
+		})
+	}
+
+	for _, r := range triggers {
+		steps = append(steps, cutoverStep{
+			Description: "adding original trigger " + r.Trigger,
+			Query:       renameTriggerTable(r.CreateMySQL, p.tempTableName),
+			Kind:        stepTrigger,
+			Table:       p.tempTableName,
+			Names:       []string{r.Trigger},
+		})
+	}
+
+	// rename our temp table to the real table name
+	// we could do an atomic rename here, but the problem is that atomic renames
+	// also rename all the constraints of other tables pointing to our original table, and
+	// we want those constraints to point to our new table instead
+	// (which is what -atomic-cutover takes care of, see atomicCutoverSteps)
+
+	// if you're doing this live, there *is* some down time, but other tools handle this the same
+	// way, so I don't think it's unreasonable if we do the same
+	steps = append(steps, cutoverStep{
+		Description: "renaming temp table",
+		Query:       p.renameSQL(),
+		Kind:        stepRename,
+		Table:       p.tempTableName,
+	})
+
+	return steps
+}
+
+// constraintNames are the names of a block of constraints, in order
+func constraintNames(constraints string) []string {
+	var names []string
+	for _, m := range constraintNamesRegexp.FindAllStringSubmatch(constraints, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// syncTrigger is one of the triggers we create on a table to mirror
+// its writes into another table
+type syncTrigger struct {
+	name  string
+	event string
+	table string
+	body  string
+}
+
+func (t syncTrigger) createSQL() string {
+	return "create trigger`" + t.name + "`after " + t.event + " on`" + t.table + "`for each row " + t.body
+}
+
+// syncTriggers builds the insert, update, and delete triggers that copy every write
+// on the source table into the target table. The source and target columns
+// have to be lined up by index, just like in our plan
+func syncTriggers(nameSuffix string, sourceTable, targetTable string, sourceColumns, targetColumns, sourcePrimaryColumns, targetPrimaryColumns []column) []syncTrigger {
+	insert := fmt.Sprintf("insert ignore into`%s`(%s)values(%s)", targetTable, quoteColumns(targetColumns), quoteColumnsPrefix(sourceColumns, "new."))
+
+	updateBld := new(strings.Builder)
+	for i, c := range sourceColumns {
+		if i != 0 {
+			updateBld.WriteByte(',')
+		}
+		updateBld.WriteByte('`')
+		updateBld.WriteString(targetColumns[i].ColumnName)
+		updateBld.WriteByte('`')
+
+		updateBld.WriteByte('=')
+
+		updateBld.WriteString("new.")
+		updateBld.WriteByte('`')
+		updateBld.WriteString(c.ColumnName)
+		updateBld.WriteByte('`')
+	}
+	update := fmt.Sprintf("update`%s`set%s where(%s)=(%s)", targetTable, updateBld.String(), quoteColumns(targetPrimaryColumns), quoteColumnsPrefix(sourcePrimaryColumns, "new."))
+
+	delete := fmt.Sprintf("delete from`%s`where(%s)=(%s);", targetTable, quoteColumns(targetPrimaryColumns), quoteColumnsPrefix(sourcePrimaryColumns, "old."))
+
+	return []syncTrigger{{
+		name:  sourceTable + "_after_insert" + nameSuffix,
+		event: "insert",
+		table: sourceTable,
+		body:  insert,
+	}, {
+		name:  sourceTable + "_after_update" + nameSuffix,
+		event: "update",
+		table: sourceTable,
+		body:  "begin\n" + insert + ";\n" + update + ";\nend",
+	}, {
+		name:  sourceTable + "_after_delete" + nameSuffix,
+		event: "delete",
+		table: sourceTable,
+		body:  delete,
+	}}
+}
+
+// trigger is one of the original table's own triggers,
+// which we have to re-create on the altered table
+type trigger struct {
+	Trigger     string
+	CreateMySQL string `mysql:"SQL Original Statement"`
+}
+
+// getTriggers gets the creation statements of all of a table's triggers,
+// except for our own sync triggers
+func getTriggers(db *mysql.Database, tableName string) ([]*trigger, error) {
+	var triggers []*trigger
+	err := db.Select(&triggers, fmt.Sprintf("show triggers where`Table`like'%s'and not`Trigger`like'%%%s'and not`Trigger`like'%%%s'", tableName, *tempTableSuffix, *oldTableSuffix), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range triggers {
+		err := db.Select(r, "show create trigger`"+r.Trigger+"`", 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return triggers, nil
+}
+
+// checkSyncTriggers makes sure all of our sync triggers
+// exist on the original table, exactly as we would create them
+func checkSyncTriggers(db *mysql.Database, p *plan) error {
+	var existing []struct {
+		Trigger   string
+		Table     string
+		Statement string
+	}
+	err := db.Select(&existing, fmt.Sprintf("show triggers where`Table`like'%s'and`Trigger`like'%%%s'", p.tableName, *tempTableSuffix), 0)
+	if err != nil {
+		return err
+	}
+
+	statements := make(map[string]string, len(existing))
+	for _, t := range existing {
+		statements[t.Trigger] = t.Statement
+	}
+
+	for _, t := range p.triggers() {
+		statement, ok := statements[t.name]
+		if !ok {
+			return fmt.Errorf("trigger %q is missing", t.name)
+		}
+		if strings.TrimSpace(statement) != strings.TrimSpace(t.body) {
+			return fmt.Errorf("trigger %q has changed", t.name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestMapColumnsPrimaryKeyOrder plans a table whose primary key isn't in the order of its
+// columns, which has to be compared and ordered by in the order of the key to be read as a range
+func TestMapColumnsPrimaryKeyOrder(t *testing.T) {
+	columns := []column{
+		{ColumnName: "A", Position: 1, DataType: "int", ColumnType: "int", PrimaryKey: true, PrimaryKeySeq: 2},
+		{ColumnName: "Name", Position: 2, DataType: "varchar", ColumnType: "varchar(32)"},
+		{ColumnName: "B", Position: 3, DataType: "int", ColumnType: "int", PrimaryKey: true, PrimaryKeySeq: 1},
+	}
+
+	p := &plan{tableName: "things", tempTableName: "things_smgla_"}
+	err := p.mapColumns(columns, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := columnNames(p.oldPrimaryColumns), []string{"B", "A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("oldPrimaryColumns = %q, want %q", got, want)
+	}
+	if got, want := columnNames(p.newPrimaryColumns), []string{"B", "A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("newPrimaryColumns = %q, want %q", got, want)
+	}
+
+	if got, want := p.rangeWhere("1,2", "3,4"), "where(`B`,`A`)>(1,2)and(`B`,`A`)<=(3,4)"; got != want {
+		t.Errorf("rangeWhere() = %s, want %s", got, want)
+	}
+	p.expandKeyset = true
+	if got, want := p.rangeWhere("1,2", ""), "where(`B`>=1 and(`B`>1 or `B`=1 and(`A`>2)))"; got != want {
+		t.Errorf("expanded rangeWhere() = %s, want %s", got, want)
+	}
+
+	if got, want := p.lastRowQuery(), "select concat_ws(',',`B`,`A`)`Bound`from`things`order by `B`desc,`A`desc limit 1"; got != want {
+		t.Errorf("lastRowQuery() = %s, want %s", got, want)
+	}
+	if got, want := p.chunkBoundQuery("", 10), "select concat_ws(',',`B`,`A`)`Bound`from`things`order by `B`,`A` limit 1 offset 9"; got != want {
+		t.Errorf("chunkBoundQuery() = %s, want %s", got, want)
+	}
+
+	fields := []int{0, 2}
+	p.sortPrimaryKeyFields(fields)
+	if want := []int{2, 0}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("sortPrimaryKeyFields() = %v, want %v", fields, want)
+	}
+}
+
+// TestMapColumnsPrimaryKeyReordered plans an alter that changes the order of the primary key,
+// where the altered table's key still has to line up with the original table's for our triggers
+func TestMapColumnsPrimaryKeyReordered(t *testing.T) {
+	oldColumns := []column{
+		{ColumnName: "A", Position: 1, DataType: "int", ColumnType: "int", PrimaryKey: true, PrimaryKeySeq: 2},
+		{ColumnName: "B", Position: 2, DataType: "int", ColumnType: "int", PrimaryKey: true, PrimaryKeySeq: 1},
+	}
+	newColumns := []column{
+		{ColumnName: "A", Position: 1, DataType: "int", ColumnType: "int", PrimaryKey: true, PrimaryKeySeq: 1},
+		{ColumnName: "B", Position: 2, DataType: "int", ColumnType: "int", PrimaryKey: true, PrimaryKeySeq: 2},
+	}
+
+	p := &plan{tableName: "things", tempTableName: "things_smgla_"}
+	err := p.mapColumns(oldColumns, newColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := columnNames(p.oldPrimaryColumns), []string{"B", "A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("oldPrimaryColumns = %q, want %q", got, want)
+	}
+	if got, want := columnNames(p.newPrimaryColumns), []string{"B", "A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("newPrimaryColumns = %q, want %q", got, want)
+	}
+}
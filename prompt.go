@@ -3,19 +3,110 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
 )
 
-func promptText() (string, error) {
-	f, err := os.CreateTemp("", "")
+// readAlter gets the alter query from wherever we were given it,
+// checking the -e flag first, then the -f flag, then -last, then stdin if
+// something is being piped into us, and finally falling back to the editor
+// so that this can be run from cron or scripts without anyone watching
+func readAlter(db *mysql.Database, tableName string) (string, error) {
+	if len(*alterExpr) != 0 {
+		return strings.TrimSpace(*alterExpr), nil
+	}
+
+	if len(*alterFile) != 0 {
+		b, err := os.ReadFile(*alterFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read alter file: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	if *lastAlter {
+		return lastHistory()
+	}
+
+	if !stdinIsTerminal() {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read alter from stdin: %w", err)
+		}
+		if s := strings.TrimSpace(string(b)); len(s) != 0 {
+			return s, nil
+		}
+	}
+
+	template, err := alterTemplate(db, tableName)
+	if err != nil {
+		return "", err
+	}
+
+	return promptText(template)
+}
+
+// alterTemplate is what the editor starts out with. If we already know what
+// table is being altered, we show its current creation statement as a
+// comment so nobody has to go look up column names in another window
+func alterTemplate(db *mysql.Database, tableName string) (string, error) {
+	bld := new(strings.Builder)
+	bld.WriteString("-- write your alter query below, lines starting with \"--\" are ignored\n")
+
+	if len(tableName) == 0 {
+		bld.WriteString("\n")
+		return bld.String(), nil
+	}
+
+	var table struct {
+		CreateMySQL string `mysql:"Create Table"`
+	}
+	err := db.Select(&table, "show create table`"+tableName+"`", 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get table creation statement: %w", err)
+	}
+
+	bld.WriteString("--\n")
+	for _, line := range strings.Split(table.CreateMySQL, "\n") {
+		bld.WriteString("-- ")
+		bld.WriteString(line)
+		bld.WriteByte('\n')
+	}
+	bld.WriteString("\nalter table`")
+	bld.WriteString(tableName)
+	bld.WriteString("`\n")
+
+	return bld.String(), nil
+}
+
+// stdinIsTerminal reports whether stdin is an actual terminal,
+// as opposed to a pipe or a file being redirected into us
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func promptText(template string) (string, error) {
+	f, err := os.CreateTemp("", "*.sql")
 	if err != nil {
 		panic(fmt.Errorf("failed to open default text editor: %w", err))
 	}
+	_, err = f.WriteString(template)
 	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write alter template: %w", err)
+	}
+	defer os.Remove(f.Name())
 
-	cmd := exec.Command("nano", f.Name())
+	editor := editorCommand()
+	cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -32,14 +123,96 @@ func promptText() (string, error) {
 		return "", fmt.Errorf("failed to read file: %w", err)
 	}
 
-	return strings.TrimSpace(string(b)), nil
+	// our template is full of comments, so we strip those
+	// out before they make their way into the alter
+	lines := strings.Split(string(b), "\n")
+	i := 0
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines[i] = line
+		i++
+	}
+
+	return strings.TrimSpace(strings.Join(lines[:i], "\n")), nil
+}
+
+// editorCommand figures out which editor to use, preferring $VISUAL,
+// then $EDITOR, then the editor from the config file, and finally nano.
+// These can have arguments, like "code --wait", so they're split up here
+func editorCommand() []string {
+	for _, e := range []string{os.Getenv("VISUAL"), os.Getenv("EDITOR"), conf.Editor} {
+		if parts := splitArgs(e); len(parts) != 0 {
+			return parts
+		}
+	}
+	return []string{"nano"}
+}
+
+// splitArgs splits a command into its arguments on whitespace,
+// the way a shell would, respecting quotes and backslash escapes
+// so that paths with spaces in them still work
+func splitArgs(s string) []string {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args
 }
 
 var reader = bufio.NewReader(os.Stdin)
 
 func yesNo(prompt string) bool {
 	fmt.Print(prompt, " Y/n: ")
-	yesNo, _ := reader.ReadString('\n')
-	yesNo = yesNo[:len(yesNo)-1]
+
+	// with -yes nobody is here to answer, so we answer for them
+	if *yes {
+		fmt.Println("y")
+		return true
+	}
+
+	yesNo, err := reader.ReadString('\n')
+	if err != nil {
+		// stdin is closed (or was already used up by the alter query),
+		// and we'd rather not assume a yes for something this destructive
+		fmt.Println()
+		return false
+	}
+	yesNo = strings.TrimSpace(yesNo)
 	return yesNo != "n"
 }
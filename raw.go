@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	dynamicstruct "github.com/Ompluscator/dynamic-struct"
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+)
+
+// spatialTypes are the data types of spatial values, which we copy as their internal bytes
+var spatialTypes = []string{"geometry", "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection", "geomcollection"}
+
+// rawLiteral is an expression for a column's value as a mysql literal, made by mysql itself,
+// so the value never becomes a Go type on its way from one table to the other. Strings are
+// hex literals with an introducer of their own character set, binary strings and spatial
+// values are plain hex literals, numbers are left the way mysql writes them, except for
+// floats, which are written as doubles, and anything else, like dates, times,
+// and years, are hex literals of the way mysql writes them
+func rawLiteral(c column) string {
+	name := "`" + c.ColumnName + "`"
+
+	var literal string
+	switch {
+	case slices.Contains(integerTypes, c.DataType), c.DataType == "decimal", c.DataType == "double":
+		literal = name
+	case c.DataType == "float":
+		// mysql writes floats with only about 6 digits, but every float is exactly a double,
+		// and doubles are written with as many digits as it takes to get them back
+		literal = name + "+0e0"
+	case c.DataType == "bit":
+		literal = name + "+0"
+	case slices.Contains(binaryTypes, c.DataType), slices.Contains(spatialTypes, c.DataType):
+		literal = "concat('X''',hex(" + name + "),'''')"
+	case c.DataType == "json":
+		literal = "concat('_utf8mb4 X''',hex(" + name + "),'''')"
+	case len(c.CharacterSetName) != 0:
+		literal = "concat('_" + c.CharacterSetName + " X''',hex(" + name + "),'''')"
+	default:
+		literal = "concat('_binary X''',hex(" + name + "),'''')"
+	}
+
+	return "ifnull(" + literal + ",'null')"
+}
+
+// rawSelectColumns is the column list for selecting rows out of the original table as
+// raw literals, aliased to the names of the altered table's columns
+func (p *plan) rawSelectColumns() string {
+	cols := make([]string, len(p.oldColumns))
+	for i, c := range p.oldColumns {
+		cols[i] = fmt.Sprintf("%s`%s`", rawLiteral(c), p.newColumns[i].ColumnName)
+	}
+	return strings.Join(cols, ",")
+}
+
+// rawRowStruct is like tableRowStruct, except every field is a literal made by
+// rawLiteral, which cool mysql puts right into its inserts without escaping
+func rawRowStruct(columns []column) (bld dynamicstruct.Builder, pkIndexes []int) {
+	rowStruct := dynamicstruct.NewStruct()
+
+	for i, c := range columns {
+		rowStruct.AddField("F"+strconv.Itoa(c.Position), new(mysql.Raw), `mysql:"`+c.ColumnName+`"`)
+		if c.PrimaryKey {
+			pkIndexes = append(pkIndexes, i)
+		}
+	}
+
+	return rowStruct, pkIndexes
+}
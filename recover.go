@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+)
+
+// recoverCutover finishes or undoes a cutover that never finished, using its journal.
+// If the original table was never dropped (or swapped out, for an atomic cutover),
+// the cutover is undone by dropping our triggers and temp table, leaving the
+// original table how it was. If it was, the cutover is finished. Either way, every step checks whether it has
+// already happened first, so this can be run as many times as it takes
+func recoverCutover(db *mysql.Database, dbDSN string, tableName string) error {
+	if len(tableName) == 0 {
+		return errors.New("recover needs the table being altered, ex: smg-live-alter recover localhost orders")
+	}
+
+	j, err := loadJournal(db, journalFile(dbDSN, tableName), tableName)
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		return fmt.Errorf("no unfinished cutover found for %q", tableName)
+	}
+	if j.Suffix != *tempTableSuffix {
+		return fmt.Errorf("the cutover was run with -suffix %q", j.Suffix)
+	}
+
+	p := &plan{tableName: j.Table, tempTableName: j.TempTable, oldTableName: j.OldTable}
+
+	originalExists, err := tableExists(db, p.tableName)
+	if err != nil {
+		return err
+	}
+	tempExists, err := tableExists(db, p.tempTableName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("found a cutover of %q from %s that stopped at step %d of %d (%s)",
+		p.tableName, j.Updated.Format("2006-01-02 15:04:05"), j.Step+1, len(j.Steps), j.Steps[j.Step].Description)
+
+	// with an atomic cutover, the original table is never missing,
+	// so the only way to tell is whether the temp table was swapped in yet
+	swapped := !tempExists && j.hasStep(stepSwap)
+
+	switch {
+	case originalExists && tempExists:
+		log.Printf("the original table %q was never dropped or swapped out", p.tableName)
+		if !yesNo("undo the cutover, dropping the temp table and triggers?") {
+			return nil
+		}
+
+		err = dropHelpers(db, p)
+		if err != nil {
+			return err
+		}
+
+	case (!originalExists && tempExists) || swapped:
+		log.Printf("the original table %q was dropped or swapped out, finishing the cutover", p.tableName)
+
+		// foreign_key_checks only goes for the connection it's set on,
+		// so every step has to run on that same connection
+		ctx := context.Background()
+		conn, err := db.Writes.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			conn.ExecContext(ctx, "set foreign_key_checks=1")
+			conn.Close()
+		}()
+
+		log.Println("disabling foreign key checks for our connection")
+		_, err = conn.ExecContext(ctx, "set foreign_key_checks=0")
+		if err != nil {
+			return err
+		}
+
+		for _, s := range j.Steps {
+			// the locks were only there so nobody would see the cutover halfway done,
+			// and it already has been, so we don't bother taking them again
+			if s.Kind == stepLock || s.Kind == stepUnlock {
+				continue
+			}
+
+			done, err := stepDone(db, s)
+			if err != nil {
+				return err
+			}
+			if done {
+				log.Println(color.HiBlackString("already done: %s", s.Description))
+				continue
+			}
+
+			log.Println(s.Description)
+			_, err = conn.ExecContext(ctx, s.Query)
+			if err != nil {
+				return err
+			}
+		}
+
+	case originalExists && !tempExists:
+		// the rename is the very last step, so the
+		// cutover finished and only the journal is left
+		log.Println("the cutover already finished")
+
+	default:
+		return fmt.Errorf("neither %q nor %q exist, there's nothing left to recover", p.tableName, p.tempTableName)
+	}
+
+	if err := j.remove(db); err != nil {
+		log.Println(color.YellowString("failed to remove journal: %v", err))
+	}
+
+	st := &state{file: stateFile(dbDSN, p.tableName)}
+	if err := st.remove(); err != nil {
+		log.Println(color.YellowString("failed to remove state: %v", err))
+	}
+
+	log.Println("recovered", p.tableName)
+
+	return nil
+}
+
+// stepDone checks whether a cutover step has already happened
+func stepDone(db *mysql.Database, s cutoverStep) (bool, error) {
+	switch s.Kind {
+	case stepDrop, stepRename, stepSwap:
+		// these all make the table they're about go away
+		exists, err := tableExists(db, s.Table)
+		return !exists, err
+	case stepConstraints:
+		// the constraints are all added in one alter,
+		// so either all of them are there or none of them are
+		if len(s.Names) == 0 {
+			return false, nil
+		}
+		return constraintExists(db, s.Table, s.Names[0])
+	case stepDropConstraints:
+		exists, err := constraintExists(db, s.Table, s.Names[0])
+		return !exists, err
+	case stepTrigger:
+		return triggerExists(db, s.Table, s.Names[0])
+	case stepDropTrigger:
+		exists, err := triggerExists(db, s.Table, s.Names[0])
+		return !exists, err
+	}
+
+	return false, fmt.Errorf("unknown cutover step %q", s.Kind)
+}
+
+func constraintExists(db *mysql.Database, tableName string, name string) (bool, error) {
+	return db.Exists("select 0 from`information_schema`.`TABLE_CONSTRAINTS`"+
+		"where`CONSTRAINT_SCHEMA`=database()"+
+		"and`TABLE_NAME`=@@table "+
+		"and`CONSTRAINT_NAME`=@@name", 0, mysql.Params{
+		"table": tableName,
+		"name":  name,
+	})
+}
+
+// triggerExists checks for a trigger on a specific table, since trigger names are
+// unique to the whole schema, and a trigger we're moving to a new table has to
+// be told apart from the same trigger still on the old one
+func triggerExists(db *mysql.Database, tableName string, name string) (bool, error) {
+	return db.Exists("select 0 from`information_schema`.`TRIGGERS`"+
+		"where`TRIGGER_SCHEMA`=database()"+
+		"and`EVENT_OBJECT_TABLE`=@@table "+
+		"and`TRIGGER_NAME`=@@name", 0, mysql.Params{
+		"table": tableName,
+		"name":  name,
+	})
+}
+
+func tableExists(db *mysql.Database, tableName string) (bool, error) {
+	return db.Exists("select 0 from`information_schema`.`TABLES`"+
+		"where`TABLE_SCHEMA`=database()"+
+		"and`TABLE_NAME`=@@table", 0, mysql.Params{
+		"table": tableName,
+	})
+}
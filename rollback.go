@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+)
+
+// errAborted is what a run fails with once it's been told to stop
+var errAborted = errors.New("aborted")
+
+// guard keeps track of how far along an alter is, so that when it fails or gets
+// interrupted we know what to do about it. Before the original table is dropped,
+// everything we've made can simply be dropped again, leaving the original table
+// exactly how we found it. After, the only way out is to finish the cutover,
+// so the best we can do is tell the user exactly how
+type guard struct {
+	// mu is held for every step that makes or drops something,
+	// so that a signal never rolls back in the middle of one
+	mu sync.Mutex
+
+	db *mysql.Database
+	p  *plan
+	st *state
+
+	// created is set once we might have made our temp table or triggers,
+	// and resumed is set instead when they're from a run we're resuming
+	created bool
+	resumed bool
+
+	// journal is where the cutover writes down each step before running it
+	journal *journal
+
+	// remaining is set once the cutover has started,
+	// and is the steps of it that haven't finished yet
+	remaining []cutoverStep
+	dropped   bool
+
+	// done is set once there's nothing left to roll back,
+	// either because we already did or because the alter finished
+	done bool
+
+	aborted   chan struct{}
+	abortOnce sync.Once
+
+	// cause is why we were aborted, if it was for
+	// something other than being told to stop
+	cause error
+}
+
+func newGuard(db *mysql.Database, p *plan) *guard {
+	return &guard{
+		db:      db,
+		p:       p,
+		aborted: make(chan struct{}),
+	}
+}
+
+// watchSignals rolls back and exits when we're interrupted or terminated.
+// A signal during the cutover waits for it to finish instead, since stopping
+// halfway through the cutover is the worst thing we could do
+func (g *guard) watchSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-ch
+		log.Println(color.YellowString("received %s, stopping", sig))
+
+		// a second signal means they really want us gone,
+		// and we'd rather they know what that leaves behind
+		go func() {
+			<-ch
+			log.Println(color.RedString("received another signal, exiting without cleaning up"))
+			log.Printf("run \"smg-live-alter cleanup <connection> %s\" to remove anything left behind", g.p.tableName)
+			os.Exit(1)
+		}()
+
+		g.abort()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if g.dropped || g.done {
+			// either the cutover finished while we were waiting,
+			// or the alter did, so there's nothing left to undo
+			return
+		}
+
+		g.rollback()
+		os.Exit(1)
+	}()
+}
+
+// abort tells everything that's watching the guard to stop
+func (g *guard) abort() {
+	g.abortOnce.Do(func() { close(g.aborted) })
+}
+
+// abortWith aborts because of err, which is what the run fails with
+func (g *guard) abortWith(err error) {
+	g.abortOnce.Do(func() {
+		g.cause = err
+		close(g.aborted)
+	})
+}
+
+// abortErr is what a run that's been aborted fails with
+func (g *guard) abortErr() error {
+	if g.cause != nil {
+		return g.cause
+	}
+	return errAborted
+}
+
+// isAborted reports whether we've been told to stop
+func (g *guard) isAborted() bool {
+	select {
+	case <-g.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// step runs fn while holding the guard, so that nothing
+// gets rolled back until it's done
+func (g *guard) step(fn func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.done || g.isAborted() {
+		return g.abortErr()
+	}
+
+	return fn()
+}
+
+// finish marks the run as having nothing left to roll back
+func (g *guard) finish() {
+	g.mu.Lock()
+	g.done = true
+	g.mu.Unlock()
+}
+
+// cutover runs each of the cutover steps, keeping track of which are left,
+// so that if one of them fails we can say exactly what still needs to happen.
+// Each step is written to the journal before it runs, so that if we die
+// without getting the chance to say, the recover command can finish it.
+// The steps are run with exec, since an atomic cutover has to run
+// every one of them on the connection holding its locks
+func (g *guard) cutover(j *journal, exec func(query string) error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.done || g.isAborted() {
+		return g.abortErr()
+	}
+
+	g.journal = j
+	steps := j.Steps
+
+	for i, s := range steps {
+		g.remaining = steps[i:]
+
+		err := j.write(g.db, i)
+		if err != nil {
+			return fmt.Errorf("failed to write journal: %w", err)
+		}
+
+		log.Println(s.Description)
+		err = exec(s.Query)
+		if err != nil {
+			return err
+		}
+
+		// once the original table has been dropped or swapped out
+		// there's no going back
+		if s.Kind == stepDrop || s.Kind == stepSwap {
+			g.dropped = true
+		}
+	}
+
+	g.remaining = nil
+	g.done = true
+
+	if err := j.remove(g.db); err != nil {
+		log.Println(color.YellowString("failed to remove journal: %v", err))
+	}
+
+	return nil
+}
+
+// fail handles a run that returned an error, either by rolling back,
+// or, if it's too late for that, printing what's left to do
+func (g *guard) fail(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.done {
+		return
+	}
+
+	log.Println(color.RedString("alter failed: %v", err))
+
+	if g.dropped {
+		g.printRecovery()
+		return
+	}
+
+	g.rollback()
+}
+
+// rollback drops our sync triggers and temp table, so that a failed run doesn't
+// leave the original table's writes paying for a copy nobody is waiting for.
+// Has to be called with the guard held
+func (g *guard) rollback() {
+	g.done = true
+
+	if g.resumed {
+		log.Println(color.YellowString("keeping the temp table and triggers this run resumed with, continue with -resume again or remove them with the cleanup command"))
+		return
+	}
+	if !g.created {
+		return
+	}
+
+	if *keepOnFailure {
+		log.Println(color.YellowString("keeping temp table and triggers, continue with -resume or remove them with the cleanup command"))
+		return
+	}
+
+	log.Println("rolling back")
+
+	if err := dropHelpers(g.db, g.p); err != nil {
+		log.Printf("run \"smg-live-alter cleanup <connection> %s\" to remove anything left behind", g.p.tableName)
+		return
+	}
+
+	if g.st != nil {
+		if err := g.st.remove(); err != nil {
+			log.Println(color.YellowString("failed to remove state: %v", err))
+		}
+	}
+
+	log.Println("rolled back, the original table is untouched")
+}
+
+// dropHelpers drops our sync triggers and then our temp table, trying all of them
+// even if one fails, and is only an error if any of them are still around.
+// The triggers go first, since they write into the temp table
+func dropHelpers(db *mysql.Database, p *plan) error {
+	var errs []error
+	for _, t := range p.triggers() {
+		log.Println("dropping trigger", t.name)
+		if err := db.Exec("drop trigger if exists`" + t.name + "`"); err != nil {
+			log.Println(color.RedString("failed to drop trigger %q: %v", t.name, err))
+			errs = append(errs, err)
+		}
+	}
+
+	log.Println("dropping temp table", p.tempTableName)
+	if err := db.Exec("drop table if exists`" + p.tempTableName + "`"); err != nil {
+		log.Println(color.RedString("failed to drop temp table %q: %v", p.tempTableName, err))
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// printRecovery prints the statements that still have to be run to finish the cutover
+// by hand. Has to be called with the guard held, after the original table was dropped
+func (g *guard) printRecovery() {
+	log.Println(color.RedString("the original table %q has already been dropped or swapped out, and the cutover has to be finished by hand!", g.p.tableName))
+	log.Printf("all of the data is in %q, run these statements with the mysql client to finish:", g.p.tempTableName)
+	fmt.Fprintln(os.Stderr, color.CyanString(recoverySQL(g.remaining)))
+	log.Printf("or run \"smg-live-alter recover <connection> %s\" to finish it from the journal", g.p.tableName)
+}
+
+// recoverySQL is the given steps as something that can be pasted into the mysql client
+func recoverySQL(steps []cutoverStep) string {
+	bld := new(strings.Builder)
+	bld.WriteString("set foreign_key_checks=0;\n")
+	bld.WriteString("DELIMITER $$\n")
+	for _, s := range steps {
+		// the locks went away with our connection,
+		// and finishing by hand doesn't need them
+		if s.Kind == stepLock || s.Kind == stepUnlock {
+			continue
+		}
+		bld.WriteString(s.Query)
+		bld.WriteString("$$\n")
+	}
+	bld.WriteString("DELIMITER ;\n")
+	return bld.String()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+)
+
+// initialServerChunkSize is how many rows the first insert...select copies, and it's
+// adjusted after every chunk to hit our target chunk time, just like the insert
+// size of the client side copy
+const initialServerChunkSize = 1000
+
+// copyRowsServer copies a range of rows from the original table into our temp table with
+// insert...select, a chunk at a time, using the same keyset pagination as the client
+// side copy. Since the rows never come back to us, there's no reflection and nothing
+// for types or charsets to get lost in, and every chunk is done once its insert is,
+// so its last primary key values are always a safe checkpoint
+func copyRowsServer(db *mysql.Database, p *plan, st *state, r *keyRange, bar *mpb.Bar, g *guard, t *throttler) error {
+	checkpoint := r.Checkpoint
+	copied := r.Copied
+	lastSave := time.Now()
+
+	size := initialServerChunkSize
+
+	for {
+		t.wait(g)
+		if g.isAborted() {
+			return g.abortErr()
+		}
+
+		chunkStart := time.Now()
+
+		var bounds []struct {
+			Bound string
+		}
+		err := db.Select(&bounds, p.chunkBoundQuery(p.rangeWhere(checkpoint, r.End), size), 0)
+		if err != nil {
+			return fmt.Errorf("failed to find end of chunk: %w", err)
+		}
+
+		// with no bound, everything that's left of the range fits in this chunk
+		last := len(bounds) == 0
+		bound := r.End
+		if !last {
+			bound = bounds[0].Bound
+		}
+
+		where := p.rangeWhere(checkpoint, bound)
+		res, err := db.ExecResult(p.insertSelectQuery(where))
+		if err != nil {
+			return fmt.Errorf("failed to copy chunk: %w", err)
+		}
+
+		// the insert reads the chunk in primary key order, so the
+		// nth row it warns about is the nth row of the chunk
+		err = reportChunkCoercions(db, func(n int) string {
+			var keys []struct {
+				Bound string
+			}
+			if err := db.Select(&keys, p.chunkBoundQuery(where, n), 0); err != nil || len(keys) == 0 {
+				return ""
+			}
+			return keys[0].Bound
+		})
+		if err != nil {
+			return err
+		}
+
+		// rows our triggers already copied are ignored, and don't count as affected,
+		// but a full chunk had exactly size rows in it when we found its bound
+		rows := int64(size)
+		if last {
+			rows, err = res.RowsAffected()
+			if err != nil {
+				return err
+			}
+		}
+		copied += rows
+		bar.IncrBy(int(rows))
+		bar.DecoratorEwmaUpdate(time.Since(chunkStart))
+
+		if len(bound) != 0 {
+			checkpoint = bound
+		}
+		if last {
+			return st.finishRange(r, checkpoint, copied)
+		}
+
+		if time.Since(lastSave) >= checkpointInterval {
+			lastSave = time.Now()
+			if err := st.checkpoint(r, checkpoint, copied); err != nil {
+				log.Println(color.YellowString("failed to save checkpoint: %v", err))
+			}
+		}
+
+		size = resizeChunk(size, time.Since(chunkStart), t.targetChunkTime())
+
+		t.limit(rows, chunkStart)
+	}
+}
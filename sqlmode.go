@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// zeroDateModes are the modes that reject zero dates, which older tables can be full
+// of, since they went in just fine under whatever mode was around when they did
+var zeroDateModes = []string{"NO_ZERO_DATE", "NO_ZERO_IN_DATE"}
+
+// copySQLMode is the sql_mode we copy rows and create our triggers with, which is the
+// one from -sql-mode or the connections file if there is one, or the one this run
+// started with if it's being resumed. Otherwise it's the session's own mode, made
+// compatible with the rows that are already in the original table, so that zero dates
+// are allowed, and so are invalid dates if the server or the table's own triggers
+// allow them. Tables don't remember the mode they were made with, but their
+// triggers do, which is as close as we can get
+func copySQLMode(db *mysql.Database, p *plan, st *state) (string, error) {
+	if st != nil && st.SQLMode != nil {
+		return *st.SQLMode, nil
+	}
+
+	var modes struct {
+		Global  string
+		Session string
+	}
+	err := db.Select(&modes, "select @@global.sql_mode`Global`,@@session.sql_mode`Session`", 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get sql_mode: %w", err)
+	}
+
+	ours := make([]string, 0, len(p.triggers()))
+	for _, t := range p.triggers() {
+		ours = append(ours, t.name)
+	}
+	var triggers []struct {
+		SQLMode string `mysql:"SQL_MODE"`
+	}
+	err = db.Select(&triggers, "select distinct`SQL_MODE`"+
+		"from`information_schema`.`triggers`"+
+		"where`EVENT_OBJECT_SCHEMA`=database()"+
+		"and`EVENT_OBJECT_TABLE`=@@table "+
+		"and`TRIGGER_NAME`not in(@@ours)", 0, mysql.Params{
+		"table": p.tableName,
+		"ours":  ours,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get sql_mode of triggers: %w", err)
+	}
+
+	log.Printf("the server's sql_mode is %q, and our session's is %q", modes.Global, modes.Session)
+	for _, t := range triggers {
+		log.Printf("%s has triggers made with sql_mode %q", p.tableName, t.SQLMode)
+	}
+
+	if len(*sqlMode) != 0 {
+		return *sqlMode, nil
+	}
+
+	var mode []string
+	for _, m := range strings.Split(modes.Session, ",") {
+		if len(m) != 0 && !slices.Contains(zeroDateModes, m) {
+			mode = append(mode, m)
+		}
+	}
+
+	others := []string{modes.Global}
+	for _, t := range triggers {
+		others = append(others, t.SQLMode)
+	}
+	for _, o := range others {
+		if slices.Contains(strings.Split(o, ","), "ALLOW_INVALID_DATES") && !slices.Contains(mode, "ALLOW_INVALID_DATES") {
+			mode = append(mode, "ALLOW_INVALID_DATES")
+		}
+	}
+
+	return strings.Join(mode, ","), nil
+}
+
+// copyDSN is the given DSN with its sessions in utc and in the given sql_mode.
+// Timestamps are read and written as strings in the session time zone, and in a
+// time zone with daylight saving time, the hour that repeats when the clocks go back
+// has two different instants for every string, but utc doesn't have any hours like that
+func copyDSN(dsn string, sqlMode string) (string, error) {
+	cfg, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	cfg.Params["sql_mode"] = "'" + sqlMode + "'"
+	return cfg.FormatDSN(), nil
+}
+
+// copyDatabase is a new connection to the same database as db, except in utc and in the
+// given sql_mode, for everything that moves rows from the original table to our temp table
+func copyDatabase(db *mysql.Database, sqlMode string) (*mysql.Database, error) {
+	writes, err := copyDSN(db.WritesDSN, sqlMode)
+	if err != nil {
+		return nil, err
+	}
+	reads, err := copyDSN(db.ReadsDSN, sqlMode)
+	if err != nil {
+		return nil, err
+	}
+	return openCopyDatabase(db, writes, reads)
+}
+
+// openCopyDatabase connects to the given DSNs like db did, with its writes on a
+// single connection that reads the warnings of each of them right after
+func openCopyDatabase(db *mysql.Database, writes, reads string) (*mysql.Database, error) {
+	c, err := mysql.NewFromDSN(writes, reads)
+	if err != nil {
+		return nil, err
+	}
+	c.Log = db.Log
+	c.DisableUnusedColumnWarnings = true
+	err = watchWarnings(c, writes)
+	if err != nil {
+		c.Writes.Close()
+		c.Reads.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// closeCopyDatabase closes the connections of a database from openCopyDatabase
+func closeCopyDatabase(c *mysql.Database) {
+	copyWarnings.Delete(c)
+	c.Writes.Close()
+	c.Reads.Close()
+}
+
+// erDupEntry is the warning of a row skipped by insert ignore because it's already
+// there, which is how every row our triggers got to first is skipped
+const erDupEntry = 1062
+
+// warningRowRegexp finds which row of a statement a warning is about
+var warningRowRegexp = regexp.MustCompile(` at row (\d+)$`)
+
+// coercedValues is how many values have been changed to fit our temp table so far,
+// by every worker, and they're reported as they're found
+var coercedValues atomic.Int64
+
+// coercion is a warning about a value that was changed to fit our temp table,
+// and the row of its statement that it's about, or 0 if it doesn't say
+type coercion struct {
+	row     int
+	message string
+}
+
+// reportCoercion tells us about a value that was changed to fit our temp table, in
+// the row with the given primary key values, instead of letting it go by quietly
+func reportCoercion(c coercion, key string) {
+	coercedValues.Add(1)
+	if len(key) == 0 {
+		key = "?"
+	}
+	log.Println(color.YellowString("value changed in row (%s): %s", key, c.message))
+}
+
+// reportChunkCoercions reports the coerced values of a chunk's statement, where
+// key gets the primary key values of the chunk's nth row
+func reportChunkCoercions(db *mysql.Database, key func(n int) string) error {
+	coercions, err := showWarnings(db)
+	if err != nil {
+		return err
+	}
+	for _, c := range coercions {
+		var k string
+		if c.row != 0 {
+			k = key(c.row)
+		}
+		reportCoercion(c, k)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// stateDir is where we keep the state of each run, so that
+// a copy that dies partway through can be resumed with -resume
+var stateDir = filepath.Join(confDir, "smgla", "state")
+
+// state is everything about a run that we need to pick up where it left off,
+// which is the run's parameters, what the tables looked like when it started,
+// and for each range of the copy, the primary key values of the last row
+// we know made it into the temp table
+type state struct {
+	Table     string `json:"table"`
+	TempTable string `json:"tempTable"`
+	Alter     string `json:"alter"`
+	Suffix    string `json:"suffix"`
+
+	// OldColumns and NewColumns are the columns of the original and temp
+	// tables, used to make sure nothing changed before we resume
+	OldColumns []string `json:"oldColumns"`
+	NewColumns []string `json:"newColumns"`
+
+	// Ranges are the parts of the primary key space copied by each of our workers,
+	// which are decided on when the run is started and kept for good, so that
+	// a resumed run picks up every range right where it left off
+	Ranges []*keyRange `json:"ranges"`
+
+	// Total is how many rows there were to copy when the run was started
+	Total int64 `json:"total"`
+
+	// DeferredIndexes are the definitions of the secondary indexes dropped from
+	// the temp table by -deferred-indexes, until they're added back after the copy
+	DeferredIndexes []string `json:"deferredIndexes,omitempty"`
+
+	// SQLMode is the sql_mode our triggers were made with, and
+	// that the copy runs with, so a resumed copy uses it too
+	SQLMode *string `json:"sqlMode,omitempty"`
+
+	// Finished is when the copy finished, and is zero until then
+	Finished time.Time `json:"finished"`
+
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	file string
+	mu   sync.Mutex
+}
+
+// keyRange is a part of the original table, by primary key, that's copied on its own.
+// It's every row after its checkpoint, up to and including its end
+type keyRange struct {
+	// Checkpoint is the primary key values of the last copied row, already
+	// escaped for mysql so we can put it right back into the where clause of our
+	// select, and starts out as the end of the range before, or empty for the first
+	Checkpoint string `json:"checkpoint,omitempty"`
+
+	// End is the primary key values of the last row of the range,
+	// escaped the same way, and is empty for the last range
+	End string `json:"end,omitempty"`
+
+	Copied int64 `json:"copied"`
+	Done   bool  `json:"done"`
+}
+
+var unsafeFileCharsRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// stateFile is the path of the state for the given table on the given database.
+// We use the host and schema from the DSN, and not the whole thing, because
+// we definitely don't want passwords in our file names
+func stateFile(dsn string, tableName string) string {
+	name := tableName
+	if c, err := mysql.ParseDSN(dsn); err == nil {
+		name = c.Addr + "-" + c.DBName + "-" + tableName
+	}
+	return filepath.Join(stateDir, unsafeFileCharsRegexp.ReplaceAllString(name, "_")+".json")
+}
+
+func newState(file string, p *plan, alterQuery string) *state {
+	return &state{
+		Table:      p.tableName,
+		TempTable:  p.tempTableName,
+		Alter:      alterQuery,
+		Suffix:     *tempTableSuffix,
+		OldColumns: columnsSignature(p.oldColumns),
+		NewColumns: columnsSignature(p.newColumns),
+		Started:    time.Now(),
+		file:       file,
+	}
+}
+
+func loadState(file string) (*state, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+	st := &state{file: file}
+	err = json.Unmarshal(b, st)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state %q: %w", file, err)
+	}
+	return st, nil
+}
+
+// checkpoint records how far the copy of a range has gotten and saves it
+func (st *state) checkpoint(r *keyRange, checkpoint string, copied int64) error {
+	st.mu.Lock()
+	r.Checkpoint = checkpoint
+	r.Copied = copied
+	st.mu.Unlock()
+
+	return st.save()
+}
+
+// finishRange records that every row of the range has been copied, and saves it
+func (st *state) finishRange(r *keyRange, checkpoint string, copied int64) error {
+	st.mu.Lock()
+	r.Checkpoint = checkpoint
+	r.Copied = copied
+	r.Done = true
+	st.mu.Unlock()
+
+	return st.save()
+}
+
+// copied is how many rows have been copied, across every range
+func (st *state) copied() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var copied int64
+	for _, r := range st.Ranges {
+		copied += r.Copied
+	}
+	return copied
+}
+
+// finishCopy records that every row has been copied, and saves it
+func (st *state) finishCopy() error {
+	st.mu.Lock()
+	st.Finished = time.Now()
+	st.mu.Unlock()
+
+	return st.save()
+}
+
+// save writes the state to a temp file first and then renames it over the
+// real one, so that dying in the middle of a save can't leave us with half a file
+func (st *state) save() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.Updated = time.Now()
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(st.file), 0o700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(st.file+".tmp", b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(st.file+".tmp", st.file)
+}
+
+func (st *state) remove() error {
+	err := os.Remove(st.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// matches makes sure the tables still look the way they did when the
+// run was started, because resuming a copy into a temp table that has
+// changed underneath us would be a great way to lose data
+func (st *state) matches(p *plan) error {
+	if st.Suffix != *tempTableSuffix {
+		return fmt.Errorf("run was started with suffix %q, not %q", st.Suffix, *tempTableSuffix)
+	}
+	if !slices.Equal(st.OldColumns, columnsSignature(p.oldColumns)) {
+		return fmt.Errorf("columns of %q have changed since the run was started", p.tableName)
+	}
+	if !slices.Equal(st.NewColumns, columnsSignature(p.newColumns)) {
+		return fmt.Errorf("columns of %q have changed since the run was started", p.tempTableName)
+	}
+	return nil
+}
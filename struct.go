@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 
@@ -73,10 +74,20 @@ func tableRowStruct(columns []column) (bld dynamicstruct.Builder, pkIndexes []in
 			// passed directly into the query with no escaping, which is know is
 			// safe here because a decimal from mysql can't contain breaking characters
 			v = new(mysql.Raw)
-		case "timestamp", "date", "datetime":
+		case "timestamp", "date", "datetime", "time":
 			v = new(string)
+		case "year":
+			v = new(int16)
 		case "binary", "varbinary", "blob", "tinyblob", "mediumblob", "longblob":
 			v = new([]byte)
+		case "bit", "vector":
+			// bits come back as the bytes of their value, and vectors as the bytes
+			// of their floats, and mysql takes both right back as binary strings
+			v = new([]byte)
+		case "geometry", "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection", "geomcollection":
+			// spatial columns are selected as calls to ST_GeomFromWKB with the value's
+			// well-known binary and SRID, which get passed right into our insert
+			v = new(mysql.Raw)
 		case "char", "varchar", "text", "tinytext", "mediumtext", "longtext", "enum":
 			v = new(string)
 		case "json":
@@ -100,3 +111,26 @@ func tableRowStruct(columns []column) (bld dynamicstruct.Builder, pkIndexes []in
 
 	return rowStruct, pkIndexes, nil
 }
+
+// rowSize is roughly how much memory a row built from tableRowStruct takes up,
+// which is mostly its strings and byte slices
+func rowSize(row reflect.Value) int {
+	size := 0
+	for i := 0; i < row.NumField(); i++ {
+		f := row.Field(i)
+		for f.Kind() == reflect.Pointer || f.Kind() == reflect.Interface {
+			if f.IsNil() {
+				break
+			}
+			f = f.Elem()
+		}
+
+		switch f.Kind() {
+		case reflect.String, reflect.Slice:
+			size += f.Len()
+		default:
+			size += int(f.Type().Size())
+		}
+	}
+	return size
+}
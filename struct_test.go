@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/vbauerster/mpb/v8"
+)
+
+func TestTableRowStructTypes(t *testing.T) {
+	tests := []struct {
+		dataType   string
+		columnType string
+		want       any
+	}{
+		{"bit", "bit(10)", new([]byte)},
+		{"year", "year", new(int16)},
+		{"time", "time(6)", new(string)},
+		{"vector", "vector(3)", new([]byte)},
+		{"geometry", "geometry", new(mysql.Raw)},
+		{"point", "point", new(mysql.Raw)},
+		{"linestring", "linestring", new(mysql.Raw)},
+		{"polygon", "polygon", new(mysql.Raw)},
+		{"multipoint", "multipoint", new(mysql.Raw)},
+		{"multilinestring", "multilinestring", new(mysql.Raw)},
+		{"multipolygon", "multipolygon", new(mysql.Raw)},
+		{"geomcollection", "geomcollection", new(mysql.Raw)},
+		{"json", "json", new(json.RawMessage)},
+		{"tinyint", "tinyint unsigned", new(uint8)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.columnType, func(t *testing.T) {
+			bld, _, err := tableRowStruct([]column{{ColumnName: "c", Position: 1, DataType: tt.dataType, ColumnType: tt.columnType}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := reflect.ValueOf(bld.Build().New()).Elem().Type().Field(0).Type
+			if want := reflect.TypeOf(tt.want); got != want {
+				t.Errorf("field type = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestTableRowStructUnknownType(t *testing.T) {
+	_, _, err := tableRowStruct([]column{{ColumnName: "c", Position: 1, DataType: "imaginary", ColumnType: "imaginary"}})
+	if err == nil {
+		t.Error("tableRowStruct() didn't fail on an unknown type")
+	}
+}
+
+// TestColumnTypesRoundTrip copies a table with bit, year, time, vector, spatial, and float columns
+// with every engine and transport, and makes sure every value comes out the other side
+func TestColumnTypesRoundTrip(t *testing.T) {
+	db := testDB(t)
+
+	const table = "smgla_test_types"
+
+	// vectors are only in mysql 9 and up
+	vectors := db.Exec("do cast(string_to_vector('[1,2,3]')as binary)") == nil
+
+	create := "create table`" + table + "`(`ID`int primary key," +
+		"`Bits`bit(10),`Year`year,`Time`time(6),`Point`point,`Shape`geometry srid 3857,`Float`float"
+	values := "(1,b'1010101010',1901,'-838:59:59.000000',ST_GeomFromText('POINT(1 2)'),ST_GeomFromText('LINESTRING(0 0,1 1)',3857),123456.789" +
+		"),(2,b'0',2155,'838:59:59.999999',ST_GeomFromText('POINT(-1.5 0.25)'),ST_GeomFromText('POLYGON((0 0,1 0,1 1,0 0))',3857),-3.14159265e-20" +
+		"),(3,null,null,null,null,null,null"
+	if vectors {
+		create += ",`Vector`vector(3)"
+		values = "(1,b'1010101010',1901,'-838:59:59.000000',ST_GeomFromText('POINT(1 2)'),ST_GeomFromText('LINESTRING(0 0,1 1)',3857),123456.789,string_to_vector('[1,2.5,-3]')" +
+			"),(2,b'0',2155,'838:59:59.999999',ST_GeomFromText('POINT(-1.5 0.25)'),ST_GeomFromText('POLYGON((0 0,1 0,1 1,0 0))',3857),-3.14159265e-20,string_to_vector('[0,0,0]')" +
+			"),(3,null,null,null,null,null,null,null"
+	}
+
+	testExec(t, db,
+		"drop table if exists`"+table+"`,`"+table+*tempTableSuffix+"`",
+		create+")",
+		"insert into`"+table+"`values"+values+")",
+	)
+	t.Cleanup(func() {
+		db.Exec("drop table if exists`" + table + "`,`" + table + *tempTableSuffix + "`")
+	})
+
+	differs := "not(s.`Bits`<=>t.`Bits`)or not(s.`Year`<=>t.`Year`)or not(s.`Time`<=>t.`Time`)" +
+		"or not(ST_AsWKB(s.`Point`)<=>ST_AsWKB(t.`Point`))or not(ST_SRID(s.`Point`)<=>ST_SRID(t.`Point`))" +
+		"or not(ST_AsWKB(s.`Shape`)<=>ST_AsWKB(t.`Shape`))or not(ST_SRID(s.`Shape`)<=>ST_SRID(t.`Shape`))" +
+		"or not(s.`Float`<=>t.`Float`)"
+	if vectors {
+		differs += "or not(s.`Vector`<=>t.`Vector`)"
+	}
+
+	engines := []struct {
+		engine    string
+		transport string
+	}{
+		{"client", "typed"},
+		{"client", "raw"},
+		{"server", "typed"},
+		{"load-data", "typed"},
+	}
+	// the flags are shared with every other test, so they go back to how we found them
+	oldEngine, oldTransport := *copyEngine, *transport
+	t.Cleanup(func() {
+		*copyEngine, *transport = oldEngine, oldTransport
+	})
+
+	for _, e := range engines {
+		t.Run(e.engine+"/"+e.transport, func(t *testing.T) {
+			*copyEngine, *transport = e.engine, e.transport
+
+			p, err := newPlan(db, table, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			testExec(t, db,
+				"drop table if exists`"+p.tempTableName+"`",
+				p.createTempTable,
+			)
+
+			oldColumns, err := getTableColumns(db, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newColumns, err := getTableColumns(db, p.tempTableName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.mapColumns(oldColumns, newColumns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mode, err := copySQLMode(db, p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copyDB, err := copyDatabase(db, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeCopyDatabase(copyDB)
+
+			st := newState(filepath.Join(t.TempDir(), "state.json"), p, "")
+			st.Ranges = []*keyRange{{}}
+
+			th, err := newThrottler(copyDB, copyDB.WritesDSN)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			progress := mpb.New(mpb.WithOutput(io.Discard))
+			bar := progress.AddBar(3)
+			err = copyRanges(copyDB, p, st, bar, newGuard(db, p), th)
+			bar.SetTotal(-1, true)
+			progress.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var count struct {
+				Copied  int64
+				Differs int64
+			}
+			err = db.Select(&count, "select count(*)`Copied`,ifnull(sum("+differs+"),0)`Differs`"+
+				"from`"+table+"`s join`"+p.tempTableName+"`t using(`ID`)", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count.Copied != 3 {
+				t.Errorf("copied %d rows, want 3", count.Copied)
+			}
+			if count.Differs != 0 {
+				t.Errorf("%d rows came out different", count.Differs)
+			}
+			if n := coercedValues.Load(); n != 0 {
+				t.Errorf("%d values were changed on the way", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/fatih/color"
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// throttleCheckAge is how long a check of whether the copy should be paused is good for,
+// so that workers starting their chunks at about the same time don't all check at once
+const throttleCheckAge = 250 * time.Millisecond
+
+// defaultChunkTime is how long we aim for each insert chunk to take
+const defaultChunkTime = 500 * time.Millisecond
+
+// replica is one of the replicas we watch the lag of while copying
+type replica struct {
+	name string
+	db   *mysql.Database
+}
+
+// throttler pauses the copy while the replicas are too far behind or the primary
+// is too busy, and aborts it when the primary is way too busy. The select and the
+// inserts both wait on it before every chunk, which is when it checks, so that
+// no chunk starts without a check from right before it
+type throttler struct {
+	db       *mysql.Database
+	replicas []replica
+
+	// checkMu is held while checking, and checked is when we last did
+	checkMu sync.Mutex
+	checked time.Time
+
+	maxLoad      map[string]int64
+	criticalLoad map[string]int64
+
+	mu     sync.Mutex
+	paused bool
+	reason string
+
+	// manual is set while the copy is paused by hand from the control socket,
+	// which wins over everything else, so it's also only resumed by hand
+	manual bool
+
+	// chunkTime is how long each insert chunk should take, and maxRowsPerSec,
+	// if it isn't 0, is how fast the select is allowed to go
+	chunkTime     time.Duration
+	maxRowsPerSec int64
+}
+
+// newThrottler sets up everything we were asked to watch. The replicas are the ones given with -replicas, or the connection's replicas in the
+// connections file, or failing those, whatever the primary says is replicating from it
+func newThrottler(db *mysql.Database, dbDSN string) (*throttler, error) {
+	t := &throttler{db: db, chunkTime: defaultChunkTime}
+
+	var err error
+	t.maxLoad, err = parseLoad(*maxLoad)
+	if err != nil {
+		return nil, fmt.Errorf("bad -max-load: %w", err)
+	}
+	t.criticalLoad, err = parseLoad(*criticalLoad)
+	if err != nil {
+		return nil, fmt.Errorf("bad -critical-load: %w", err)
+	}
+
+	if *maxLag > 0 {
+		dsns, err := replicaDSNs(db, dbDSN)
+		if err != nil {
+			return nil, err
+		}
+		if len(dsns) == 0 {
+			log.Println(color.YellowString("-max-lag was given, but there aren't any replicas to watch"))
+		}
+
+		for name, dsn := range dsns {
+			r, err := mysql.NewFromDSN(dsn, dsn)
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect to replica %s: %w", name, err)
+			}
+			r.DisableUnusedColumnWarnings = true
+
+			log.Println("watching replication lag on", name)
+			t.replicas = append(t.replicas, replica{name: name, db: r})
+		}
+	}
+
+	return t, nil
+}
+
+// parseLoad parses status variable thresholds like "Threads_running=50,Threads_connected=800"
+func parseLoad(s string) (map[string]int64, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	load := make(map[string]int64)
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't name=value", part)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a number", value)
+		}
+		load[name] = n
+	}
+	return load, nil
+}
+
+// replicaDSNs are the DSNs of the replicas to watch, keyed by a name we can show the user
+func replicaDSNs(db *mysql.Database, dbDSN string) (map[string]string, error) {
+	connections, _ := getConnections(*connectionsFile)
+
+	var names []string
+	if len(*replicasFlag) != 0 {
+		names = strings.Split(*replicasFlag, ",")
+	} else if c, ok := connections[(*args)[0]]; ok {
+		names = c.Replicas
+	}
+
+	dsns := make(map[string]string)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if c, ok := connections[name]; ok {
+			dsns[name] = connectionToDSN(c)
+		} else {
+			dsns[name] = name
+		}
+	}
+	if len(dsns) != 0 {
+		return dsns, nil
+	}
+
+	// nobody told us about any replicas, so we ask the primary, which only knows their
+	// hosts if they set report_host, and we log in to them the same way as the primary
+	var hosts []struct {
+		Host string
+		Port int
+	}
+	err := db.Select(&hosts, "show replicas", 0)
+	if err != nil {
+		// before 8.0.22
+		err = db.Select(&hosts, "show slave hosts", 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find replicas: %w", err)
+		}
+	}
+
+	cfg, err := mysqldriver.ParseDSN(dbDSN)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if len(h.Host) == 0 {
+			log.Println(color.YellowString("found a replica without report_host set, it can't be watched"))
+			continue
+		}
+		addr := net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
+		c := cfg.Clone()
+		c.Addr = addr
+		dsns[addr] = c.FormatDSN()
+	}
+
+	return dsns, nil
+}
+
+// lag is how far behind the replica is, from the heartbeat table if we have one,
+// since that's to the microsecond and not fooled by a stopped io thread
+func (r replica) lag() (time.Duration, error) {
+	if len(*heartbeatTable) != 0 {
+		var heartbeat struct {
+			Lag *int64
+		}
+		err := r.db.Select(&heartbeat, "select timestampdiff(microsecond,max(`ts`),utc_timestamp(6))`Lag`from`"+
+			strings.ReplaceAll(*heartbeatTable, ".", "`.`")+"`", 0)
+		if err != nil {
+			return 0, err
+		}
+		if heartbeat.Lag == nil {
+			return 0, fmt.Errorf("%s is empty", *heartbeatTable)
+		}
+		return time.Duration(*heartbeat.Lag) * time.Microsecond, nil
+	}
+
+	var status []struct {
+		SecondsBehindSource *int64 `mysql:"Seconds_Behind_Source"`
+		SecondsBehindMaster *int64 `mysql:"Seconds_Behind_Master"`
+	}
+	err := r.db.Select(&status, "show replica status", 0)
+	if err != nil {
+		// before 8.0.22
+		err = r.db.Select(&status, "show slave status", 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(status) == 0 {
+		return 0, fmt.Errorf("it isn't replicating")
+	}
+
+	// with multiple sources, we're only as caught up as the furthest behind
+	var lag time.Duration
+	for _, s := range status {
+		seconds := s.SecondsBehindSource
+		if seconds == nil {
+			seconds = s.SecondsBehindMaster
+		}
+		if seconds == nil {
+			return 0, fmt.Errorf("replication is stopped")
+		}
+		if d := time.Duration(*seconds) * time.Second; d > lag {
+			lag = d
+		}
+	}
+	return lag, nil
+}
+
+// refresh checks again, unless the last check is still fresh enough to go on. Anything
+// we can't check is treated as a reason to pause, since not knowing is no reason
+// to make things worse, and being past the critical load aborts the copy
+func (t *throttler) refresh(g *guard) {
+	t.checkMu.Lock()
+	defer t.checkMu.Unlock()
+
+	if time.Since(t.checked) < throttleCheckAge {
+		return
+	}
+
+	reason, err := t.check()
+	t.checked = time.Now()
+	if err != nil {
+		log.Println(color.RedString("aborting copy: %v", err))
+		g.abortWith(err)
+		return
+	}
+	t.set(reason)
+}
+
+// check is why the copy should be paused right now, and is empty if it shouldn't be.
+// It's an error if the primary is past its critical load, and the copy should stop
+func (t *throttler) check() (string, error) {
+	if len(t.maxLoad) != 0 || len(t.criticalLoad) != 0 {
+		status, err := t.globalStatus()
+		if err != nil {
+			return fmt.Sprintf("can't check load: %v", err), nil
+		}
+
+		for name, max := range t.criticalLoad {
+			if v, ok := status[strings.ToLower(name)]; ok && v >= max {
+				return "", fmt.Errorf("%s is %d, past the critical load of %d", name, v, max)
+			}
+		}
+		for name, max := range t.maxLoad {
+			if v, ok := status[strings.ToLower(name)]; ok && v >= max {
+				return fmt.Sprintf("%s is %d", name, v), nil
+			}
+		}
+	}
+
+	if len(*throttleQuery) != 0 {
+		var v sql.NullString
+		err := t.db.Writes.QueryRow(*throttleQuery).Scan(&v)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Sprintf("can't run throttle query: %v", err), nil
+		}
+		if v.Valid {
+			n, err := strconv.ParseFloat(v.String, 64)
+			if err != nil || n != 0 {
+				return "throttle query returned " + v.String, nil
+			}
+		}
+	}
+
+	for _, r := range t.replicas {
+		lag, err := r.lag()
+		if err != nil {
+			return fmt.Sprintf("can't check lag on %s: %v", r.name, err), nil
+		}
+		if lag > *maxLag {
+			return fmt.Sprintf("%s is %s behind", r.name, lag.Round(time.Millisecond)), nil
+		}
+	}
+
+	return "", nil
+}
+
+// globalStatus gets the values of the status variables we're watching
+func (t *throttler) globalStatus() (map[string]int64, error) {
+	names := make([]any, 0, len(t.maxLoad)+len(t.criticalLoad))
+	for name := range t.maxLoad {
+		names = append(names, name)
+	}
+	for name := range t.criticalLoad {
+		names = append(names, name)
+	}
+
+	var rows []struct {
+		VariableName string `mysql:"Variable_name"`
+		Value        string
+	}
+	err := t.db.Select(&rows, "show global status where`Variable_name`in(@@names)", 0, mysql.Params{
+		"names": names,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// status variable names aren't case sensitive, but our map is
+	status := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		if v, err := strconv.ParseInt(r.Value, 10, 64); err == nil {
+			status[strings.ToLower(r.VariableName)] = v
+		}
+	}
+	return status, nil
+}
+
+// set pauses the copy with the reason, or unpauses it if there isn't one
+func (t *throttler) set(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	paused := len(reason) != 0
+	if !t.manual {
+		if paused && !t.paused {
+			log.Println(color.YellowString("pausing copy: %s", reason))
+		} else if !paused && t.paused {
+			log.Println("resuming copy")
+		}
+	}
+	t.paused = paused
+	t.reason = reason
+}
+
+// pause pauses the copy until resume is called
+func (t *throttler) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.manual {
+		log.Println(color.YellowString("pausing copy from the control socket"))
+	}
+	t.manual = true
+}
+
+// resume undoes pause, but the copy stays paused if there's another reason for it
+func (t *throttler) resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.manual {
+		log.Println("resuming copy from the control socket")
+	}
+	t.manual = false
+}
+
+// status is why the copy is paused, and is empty if it isn't
+func (t *throttler) status() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.manual {
+		return "from the control socket"
+	}
+	return t.reason
+}
+
+// wait checks whether the copy should be paused before a chunk,
+// and blocks for as long as it is, or until we're aborted
+func (t *throttler) wait(g *guard) {
+	for !g.isAborted() {
+		t.refresh(g)
+		if len(t.status()) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (t *throttler) targetChunkTime() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.chunkTime
+}
+
+func (t *throttler) setChunkTime(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.chunkTime = d
+}
+
+func (t *throttler) setMaxRowsPerSec(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxRowsPerSec = n
+}
+
+// limit sleeps for however long it takes for the rows selected since start
+// to have been selected no faster than maxRowsPerSec
+func (t *throttler) limit(rows int64, start time.Time) {
+	t.mu.Lock()
+	maxRowsPerSec := t.maxRowsPerSec
+	t.mu.Unlock()
+
+	if maxRowsPerSec <= 0 || rows <= 0 {
+		return
+	}
+
+	took := time.Duration(float64(rows) / float64(maxRowsPerSec) * float64(time.Second))
+	time.Sleep(took - time.Since(start))
+}
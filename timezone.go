@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+)
+
+// verifyChunkSize is how many rows of the original table each query of
+// the timestamp check looks at
+const verifyChunkSize = 10000
+
+// timestampCheckQuery counts the rows of the original table matching where whose copy
+// in our temp table has a different instant in any of the given columns. Comparing two
+// timestamps compares them as datetimes in the session time zone, so we compare their
+// unix timestamps instead, which are the same in every time zone
+func (p *plan) timestampCheckQuery(where string, cols []int) string {
+	keys := make([]string, len(p.oldPrimaryColumns))
+	for i, c := range p.oldPrimaryColumns {
+		keys[i] = fmt.Sprintf("`%s`.`%s`=`%s`.`%s`", p.tempTableName, p.newPrimaryColumns[i].ColumnName, p.tableName, c.ColumnName)
+	}
+
+	diffs := make([]string, len(cols))
+	for i, c := range cols {
+		diffs[i] = fmt.Sprintf("not(unix_timestamp(`%s`.`%s`)<=>unix_timestamp(`%s`.`%s`))",
+			p.tempTableName, p.newColumns[c].ColumnName, p.tableName, p.oldColumns[c].ColumnName)
+	}
+
+	if len(where) == 0 {
+		where = "where"
+	} else {
+		where += "and"
+	}
+
+	return "select count(*)`Count`from`" + p.tableName + "`" + where +
+		" exists(select 0 from`" + p.tempTableName + "`" +
+		"where" + strings.Join(keys, "and") + "and(" + strings.Join(diffs, "or") + "))"
+}
+
+// verifyTimestamps makes sure every timestamp copied into our temp table is the same
+// instant it was in the original table, a chunk of the original table at a time.
+// Only timestamps that stay timestamps of the same precision are checked, since
+// anything else is changed by the alter on purpose
+func verifyTimestamps(db *mysql.Database, p *plan, g *guard, t *throttler) error {
+	var cols []int
+	for i, c := range p.oldColumns {
+		if c.DataType == "timestamp" && p.newColumns[i].ColumnType == c.ColumnType {
+			cols = append(cols, i)
+		}
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+
+	log.Printf("checking %d timestamp columns", len(cols))
+
+	var prev string
+	var mismatched int64
+	for {
+		t.wait(g)
+		if g.isAborted() {
+			return g.abortErr()
+		}
+
+		var bounds []struct {
+			Bound string
+		}
+		err := db.Select(&bounds, p.chunkBoundQuery(p.rangeWhere(prev, ""), verifyChunkSize), 0)
+		if err != nil {
+			return fmt.Errorf("failed to find end of chunk: %w", err)
+		}
+
+		// with no bound, the rest of the table is the last chunk
+		var bound string
+		if len(bounds) != 0 {
+			bound = bounds[0].Bound
+		}
+
+		var count struct {
+			Count int64
+		}
+		err = db.Select(&count, p.timestampCheckQuery(p.rangeWhere(prev, bound), cols), 0)
+		if err != nil {
+			return fmt.Errorf("failed to check timestamps: %w", err)
+		}
+		mismatched += count.Count
+
+		if len(bound) == 0 {
+			break
+		}
+		prev = bound
+	}
+
+	if mismatched != 0 {
+		return fmt.Errorf("%d rows were copied with timestamps that aren't the same instant as the original table's", mismatched)
+	}
+
+	log.Println("every timestamp is the same instant it was")
+	return nil
+}
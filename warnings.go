@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// copyWarnings has the connector of each of our copy databases' writes
+var copyWarnings sync.Map
+
+// watchWarnings swaps the pool db writes with for one whose connections read the warnings
+// of each write right after it, before anything else can run on them. The pool only ever
+// has the one connection, so the connection that made db's last write is the one its
+// last insert ran on, and its warnings are read straight off of that connection
+// without waiting on the pool, which the insert might not have let go of yet
+func watchWarnings(db *mysql.Database, dsn string) error {
+	cfg, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	connector, err := mysqldriver.NewConnector(cfg)
+	if err != nil {
+		return err
+	}
+
+	c := &warningsConnector{Connector: connector}
+	pool := sql.OpenDB(c)
+	copyPoolSettings(pool, db.Writes)
+	pool.SetMaxOpenConns(1)
+
+	db.Writes.Close()
+	db.Writes = pool
+	copyWarnings.Store(db, c)
+	return nil
+}
+
+// copyPoolSettings gives pool the same idle connections and connection lifetimes as from.
+// database/sql has no way to ask a pool for its settings, so they're read from its fields,
+// and any that aren't there anymore are left at database/sql's defaults
+func copyPoolSettings(pool, from *sql.DB) {
+	v := reflect.ValueOf(from).Elem()
+
+	// zero is database/sql's default, and anything under it is none at all
+	if f := v.FieldByName("maxIdleCount"); f.IsValid() && f.CanInt() && f.Int() != 0 {
+		pool.SetMaxIdleConns(max(int(f.Int()), 0))
+	}
+	if f := v.FieldByName("maxLifetime"); f.IsValid() && f.CanInt() {
+		pool.SetConnMaxLifetime(time.Duration(f.Int()))
+	}
+	if f := v.FieldByName("maxIdleTime"); f.IsValid() && f.CanInt() {
+		pool.SetConnMaxIdleTime(time.Duration(f.Int()))
+	}
+}
+
+// showWarnings gets the warnings of the last write on db, other
+// than rows skipped for already being there
+func showWarnings(db *mysql.Database) ([]coercion, error) {
+	v, ok := copyWarnings.Load(db)
+	if !ok {
+		return nil, fmt.Errorf("warnings aren't being read for this connection")
+	}
+
+	conn := v.(*warningsConnector).lastWrite()
+	if conn == nil {
+		return nil, nil
+	}
+	return conn.lastWarnings()
+}
+
+// warningsConnector makes connections that read their warnings after every write,
+// and keeps track of which of them made the last write
+type warningsConnector struct {
+	driver.Connector
+
+	mu   sync.Mutex
+	last *warningsConn
+}
+
+func (c *warningsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &warningsConn{Conn: conn, connector: c}, nil
+}
+
+func (c *warningsConnector) lastWrite() *warningsConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// warningsConn is a connection of the driver's that reads its warnings after every write,
+// and passes everything else right through, so database/sql uses it the same way
+type warningsConn struct {
+	driver.Conn
+	connector *warningsConnector
+
+	// the warnings of the last write on this connection
+	mu       sync.Mutex
+	warnings []coercion
+	err      error
+}
+
+// wrote reads the warnings of the write that just finished on this connection
+func (c *warningsConn) wrote(ctx context.Context) {
+	coercions, err := c.showWarnings(ctx)
+
+	c.mu.Lock()
+	c.warnings, c.err = coercions, err
+	c.mu.Unlock()
+
+	c.connector.mu.Lock()
+	c.connector.last = c
+	c.connector.mu.Unlock()
+}
+
+func (c *warningsConn) lastWarnings() ([]coercion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.warnings, c.err
+}
+
+func (c *warningsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	res, err := execer.ExecContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	c.wrote(ctx)
+	return res, nil
+}
+
+// showWarnings reads the warnings of the last statement on this connection
+func (c *warningsConn) showWarnings(ctx context.Context) ([]coercion, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, fmt.Errorf("failed to show warnings: the driver can't query")
+	}
+	rows, err := queryer.QueryContext(ctx, "show warnings", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to show warnings: %w", err)
+	}
+	defer rows.Close()
+
+	var coercions []coercion
+	dest := make([]driver.Value, len(rows.Columns()))
+	for {
+		err = rows.Next(dest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// warnings come as Level, Code, and Message
+		code, _ := strconv.Atoi(driverString(dest[1]))
+		if code == erDupEntry {
+			continue
+		}
+		message := driverString(dest[2])
+		co := coercion{message: driverString(dest[0]) + " " + strconv.Itoa(code) + ": " + message}
+		if m := warningRowRegexp.FindStringSubmatch(message); m != nil {
+			co.row, _ = strconv.Atoi(m[1])
+		}
+		coercions = append(coercions, co)
+	}
+
+	return coercions, nil
+}
+
+func driverString(v driver.Value) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (c *warningsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if queryer, ok := c.Conn.(driver.QueryerContext); ok {
+		return queryer.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+// PrepareContext wraps the driver's statement, since database/sql runs every write
+// with arguments that the driver won't put into the query itself as a prepared statement
+func (c *warningsConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &warningsStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *warningsConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *warningsConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() //nolint:staticcheck // only if the driver is older than BeginTx
+}
+
+func (c *warningsConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *warningsConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *warningsConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *warningsConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// warningsStmt is a prepared statement of the driver's that
+// reads the warnings of its connection after every write
+type warningsStmt struct {
+	driver.Stmt
+	conn *warningsConn
+}
+
+func (s *warningsStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = execer.ExecContext(ctx, args)
+	} else {
+		values := make([]driver.Value, len(args))
+		for i, a := range args {
+			values[i] = a.Value
+		}
+		res, err = s.Stmt.Exec(values) //nolint:staticcheck // only if the driver is older than ExecContext
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn.wrote(ctx)
+	return res, nil
+}
+
+func (s *warningsStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	return s.Stmt.Query(values) //nolint:staticcheck // only if the driver is older than QueryContext
+}
+
+func (s *warningsStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+func TestCopyPoolSettings(t *testing.T) {
+	connector, err := mysqldriver.NewConnector(mysqldriver.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := sql.OpenDB(connector)
+	defer from.Close()
+	from.SetMaxIdleConns(7)
+	from.SetConnMaxLifetime(3 * time.Minute)
+	from.SetConnMaxIdleTime(time.Minute)
+
+	pool := sql.OpenDB(connector)
+	defer pool.Close()
+	copyPoolSettings(pool, from)
+
+	v := reflect.ValueOf(pool).Elem()
+	if got := v.FieldByName("maxIdleCount").Int(); got != 7 {
+		t.Errorf("max idle connections = %d, want 7", got)
+	}
+	if got := time.Duration(v.FieldByName("maxLifetime").Int()); got != 3*time.Minute {
+		t.Errorf("max lifetime = %s, want 3m", got)
+	}
+	if got := time.Duration(v.FieldByName("maxIdleTime").Int()); got != time.Minute {
+		t.Errorf("max idle time = %s, want 1m", got)
+	}
+}
+
+// TestShowWarnings makes sure the warnings of a write are read from the connection it ran on,
+// whether it was sent as a plain query or as a prepared statement
+func TestShowWarnings(t *testing.T) {
+	db := testDB(t)
+
+	const table = "smgla_test_warnings"
+
+	testExec(t, db,
+		"drop table if exists`"+table+"`",
+		"create table`"+table+"`(`ID`int primary key,`Small`tinyint)",
+	)
+	t.Cleanup(func() {
+		db.Exec("drop table if exists`" + table + "`")
+	})
+
+	copyDB, err := copyDatabase(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeCopyDatabase(copyDB)
+
+	tests := []struct {
+		name  string
+		query string
+		args  []any
+	}{
+		{"query", "insert ignore into`" + table + "`values(1,1),(2,300)", nil},
+		{"prepared", "insert ignore into`" + table + "`values(3,?),(4,?)", []any{1, 300}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := copyDB.Writes.Exec(tt.query, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			coercions, err := showWarnings(copyDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(coercions) != 1 || coercions[0].row != 2 {
+				t.Errorf("showWarnings() = %+v, want a warning about row 2", coercions)
+			}
+		})
+	}
+}
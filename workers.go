@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"slices"
+	"sync"
+
+	mysql "github.com/StirlingMarketingGroup/cool-mysql"
+	"github.com/vbauerster/mpb/v8"
+)
+
+// integerTypes are the data types we can split into ranges with
+// just arithmetic, instead of having to walk the primary key
+var integerTypes = []string{"tinyint", "smallint", "mediumint", "int", "bigint"}
+
+// estimateRows guesses how many rows of the original table there are up to and including
+// the primary key values of last, without reading them. A single integer primary key
+// can't have more rows than there are values between its min and last, which is exact
+// for auto increments without gaps, and anything else gets the estimate from
+// information_schema, which is the same one explain uses
+func estimateRows(db *mysql.Database, p *plan, last string) (int64, error) {
+	if len(p.oldPrimaryColumns) == 1 && slices.Contains(integerTypes, p.oldPrimaryColumns[0].DataType) {
+		var bounds struct {
+			Min string
+		}
+		err := db.Select(&bounds, "select cast(min("+quoteColumns(p.oldPrimaryColumns)+")as char)`Min`from`"+p.tableName+"`", 0)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get primary key bounds: %w", err)
+		}
+
+		min, _ := new(big.Int).SetString(bounds.Min, 10)
+		max, _ := new(big.Int).SetString(last, 10)
+		if min != nil && max != nil {
+			n := new(big.Int).Sub(max, min)
+			n.Add(n, big.NewInt(1))
+			if n.IsInt64() {
+				return n.Int64(), nil
+			}
+		}
+	}
+
+	var table struct {
+		Rows int64
+	}
+	err := db.Select(&table, "select ifnull(`TABLE_ROWS`,0)`Rows`"+
+		"from`information_schema`.`TABLES`"+
+		"where`TABLE_SCHEMA`=database()"+
+		"and`TABLE_NAME`=@@table", 0, mysql.Params{
+		"table": p.tableName,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate row count: %w", err)
+	}
+	return table.Rows, nil
+}
+
+// splitRanges splits the original table, up to and including the primary key values of
+// last, into n ranges by primary key, for n workers to copy at the same time. A single
+// integer primary key is split evenly between its min and last, and anything else is
+// walked with the same query that finds the end of each chunk of the server side
+// copy, to find roughly count/n rows per range, with count being our estimate
+func splitRanges(db *mysql.Database, p *plan, n int, last string, count int64) ([]*keyRange, error) {
+	var ends []string
+	switch {
+	case n <= 1:
+		// nothing to split
+
+	case len(p.oldPrimaryColumns) == 1 && slices.Contains(integerTypes, p.oldPrimaryColumns[0].DataType):
+		var bounds struct {
+			Min string
+		}
+		err := db.Select(&bounds, "select cast(min("+quoteColumns(p.oldPrimaryColumns)+")as char)`Min`from`"+p.tableName+"`", 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get primary key bounds: %w", err)
+		}
+
+		min, _ := new(big.Int).SetString(bounds.Min, 10)
+		max, _ := new(big.Int).SetString(last, 10)
+		if min == nil || max == nil {
+			return nil, fmt.Errorf("failed to parse primary key bounds %q and %q", bounds.Min, last)
+		}
+
+		width := new(big.Int).Sub(max, min)
+		for i := 1; i < n; i++ {
+			end := new(big.Int).Mul(width, big.NewInt(int64(i)))
+			end.Quo(end, big.NewInt(int64(n)))
+			end.Add(end, min)
+
+			// small tables can't be split into as many ranges as we'd like
+			if s := end.String(); len(ends) == 0 || ends[len(ends)-1] != s {
+				ends = append(ends, s)
+			}
+		}
+
+	default:
+		step := count / int64(n)
+
+		var prev string
+		for i := 1; i < n && step >= 1; i++ {
+			var bounds []struct {
+				Bound string
+			}
+			err := db.Select(&bounds, p.chunkBoundQuery(p.rangeWhere(prev, last), int(step)), 0)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find end of range: %w", err)
+			}
+			if len(bounds) == 0 || bounds[0].Bound == last {
+				break
+			}
+			prev = bounds[0].Bound
+			ends = append(ends, prev)
+		}
+	}
+
+	// each range starts right after the end of the one before
+	ranges := make([]*keyRange, 0, len(ends)+1)
+	var prev string
+	for _, end := range ends {
+		ranges = append(ranges, &keyRange{Checkpoint: prev, End: end})
+		prev = end
+	}
+	ranges = append(ranges, &keyRange{Checkpoint: prev, End: last})
+
+	return ranges, nil
+}
+
+// copyRanges copies every range that isn't done yet, each with its own worker.
+// The first one to fail aborts the others, and its error is the one we return
+func copyRanges(db *mysql.Database, p *plan, st *state, bar *mpb.Bar, g *guard, t *throttler) error {
+	var todo []*keyRange
+	for _, r := range st.Ranges {
+		if !r.Done {
+			todo = append(todo, r)
+		}
+	}
+
+	switch len(todo) {
+	case 0:
+		return nil
+	case 1:
+		log.Println("copying all the rows!")
+	default:
+		log.Printf("copying all the rows with %d workers!", len(todo))
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range todo {
+		r := r
+
+		// every engine reads the warnings of the last write its db made, and the
+		// client side copy sizes its inserts with the max insert size of its db, so
+		// each worker needs its own, or they'd be reading each other's warnings
+		// and resizing each other's inserts
+		workerDB := db
+		if len(todo) > 1 {
+			var err error
+			workerDB, err = openCopyDatabase(db, db.WritesDSN, db.ReadsDSN)
+			if err != nil {
+				g.abortWith(err)
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if workerDB != db {
+				defer closeCopyDatabase(workerDB)
+			}
+
+			var err error
+			switch *copyEngine {
+			case "client":
+				err = copyRows(workerDB, p, st, r, bar, g, t)
+			case "load-data":
+				err = copyRowsLoadData(workerDB, p, st, r, bar, g, t)
+			default:
+				err = copyRowsServer(workerDB, p, st, r, bar, g, t)
+			}
+			if err != nil {
+				g.abortWith(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if g.isAborted() {
+		return g.abortErr()
+	}
+	return nil
+}